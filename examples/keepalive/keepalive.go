@@ -0,0 +1,73 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync/atomic"
+
+	"../../irmin"
+)
+
+// irmin init -d -v --root /tmp/irmin/test -a http://:8080
+
+// connCounter is a http.RoundTripper that counts new and reused connections
+type connCounter struct {
+	rt       http.RoundTripper
+	newConns int64
+	reused   int64
+}
+
+func (c *connCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&c.reused, 1)
+			} else {
+				atomic.AddInt64(&c.newConns, 1)
+			}
+		},
+	}
+	return c.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+func main() {
+	uri, err := url.Parse("http://127.0.0.1:8080")
+	if err != nil {
+		panic(err)
+	}
+
+	counter := &connCounter{rt: http.DefaultTransport}
+	r := irmin.Create(uri, "keepalive")
+	r.SetTransport(counter)
+
+	key := irmin.ParsePath("/keepalive/test")
+	if _, err = r.Update(r.NewTask("keepalive test"), key, irmin.NewValue("hello")); err != nil {
+		panic(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err = r.Read(key); err != nil {
+			panic(err)
+		}
+	}
+
+	// Replies are read to the end and closed, so all reads should share a single connection
+	fmt.Printf("new connections: %d, reused connections: %d\n", counter.newConns, counter.reused)
+}
@@ -128,7 +128,7 @@ func main() {
 		oldData := []byte("Hello world")
 		newData := []byte("asdf")
 		fmt.Printf("compare-and-set %s=%s to %s\n", key, oldData, newData)
-		hash, err := r.CompareAndSet(r.NewTask("compare-and-set key"), irmin.ParsePath(key), &oldData, &newData)
+		hash, _, err := r.CompareAndSet(r.NewTask("compare-and-set key"), irmin.ParsePath(key), &oldData, &newData)
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,156 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PathValue is a key and the value to store in it
+type PathValue struct {
+	Path  Path
+	Value []byte
+}
+
+// PathError is an error that occurred while writing or processing a key
+type PathError struct {
+	Path Path
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path.String(), e.Err)
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned by UpdateMany and RemoveMany when a batch was only partially applied
+type BatchError struct {
+	Succeeded []Path       // keys that were written before the failure
+	Failed    []*PathError // keys that failed
+	Skipped   []Path       // keys that were not attempted
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		msgs[i] = f.Error()
+	}
+	return fmt.Sprintf("batch partially applied: %d succeeded, %d failed, %d skipped: %s", len(e.Succeeded), len(e.Failed), len(e.Skipped), strings.Join(msgs, "; "))
+}
+
+// UpdateMany updates several keys. Returns the hash of the last commit.
+//
+// The Irmin REST API has no batch command, so every key is updated with a separate Update and results in its own commit. The batch is not atomic: it stops at the first failure and returns a *BatchError listing the keys that were written, the key that failed and the keys that were skipped. Use a View (see CreateView) to apply several changes in a single transaction.
+func (rest *Conn) UpdateMany(t Task, values []PathValue) (string, error) {
+	var hash string
+	for i, v := range values {
+		h, err := rest.Update(t, v.Path, v.Value)
+		if err != nil {
+			be := &BatchError{Failed: []*PathError{{v.Path, err}}}
+			for _, w := range values[:i] {
+				be.Succeeded = append(be.Succeeded, w.Path)
+			}
+			for _, w := range values[i+1:] {
+				be.Skipped = append(be.Skipped, w.Path)
+			}
+			return hash, be
+		}
+		hash = h
+	}
+	return hash, nil
+}
+
+// RemoveMany removes several keys. Like UpdateMany every key is removed with a separate commit and the batch is not atomic. A *BatchError is returned if the batch was only partially applied.
+func (rest *Conn) RemoveMany(t Task, paths []Path) error {
+	for i, p := range paths {
+		if err := rest.Remove(t, p); err != nil {
+			return &BatchError{
+				Succeeded: append([]Path{}, paths[:i]...),
+				Failed:    []*PathError{{p, err}},
+				Skipped:   append([]Path{}, paths[i+1:]...),
+			}
+		}
+	}
+	return nil
+}
+
+// Batch collects updates and removals that are written with a single task, so all commits of a logically grouped change share the same owner, message and date
+type Batch struct {
+	srv  *Conn
+	task Task
+	ops  []batchOp
+}
+
+type batchOp struct {
+	path   Path
+	value  []byte
+	remove bool
+}
+
+// NewBatch creates a batch that writes all its changes with task t
+func (rest *Conn) NewBatch(t Task) *Batch {
+	return &Batch{srv: rest, task: t}
+}
+
+// Update adds an update of a key to the batch
+func (b *Batch) Update(path Path, contents []byte) {
+	b.ops = append(b.ops, batchOp{path: path, value: contents})
+}
+
+// Remove adds a removal of a key to the batch
+func (b *Batch) Remove(path Path) {
+	b.ops = append(b.ops, batchOp{path: path, remove: true})
+}
+
+// Len returns the number of changes in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit writes the changes in the order they were added. The task date is set once when Commit is called and used for every change. Like UpdateMany this is not atomic and a *BatchError is returned if only some changes were written. Returns the hash of the last update.
+func (b *Batch) Commit() (string, error) {
+	t := b.task
+	t.Date = fmt.Sprintf("%d", time.Now().Unix())
+	var hash string
+	for i, op := range b.ops {
+		var err error
+		if op.remove {
+			err = b.srv.Remove(t, op.path)
+		} else {
+			var h string
+			if h, err = b.srv.Update(t, op.path, op.value); err == nil {
+				hash = h
+			}
+		}
+		if err != nil {
+			be := &BatchError{Failed: []*PathError{{op.path, err}}}
+			for _, o := range b.ops[:i] {
+				be.Succeeded = append(be.Succeeded, o.path)
+			}
+			for _, o := range b.ops[i+1:] {
+				be.Skipped = append(be.Skipped, o.path)
+			}
+			return hash, be
+		}
+	}
+	return hash, nil
+}
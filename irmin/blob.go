@@ -0,0 +1,80 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"fmt"
+)
+
+type blobReadReply stringArrayReply
+type blobAddReply stringReply
+
+// ReadBlob reads a value from Irmin's content-addressed contents store by its hash, independent of any path or tree. Returns ErrNotFound if the store has no contents with this hash.
+func (rest *Conn) ReadBlob(hash string) ([]byte, error) {
+	var data blobReadReply
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+	uri, err := rest.MakeCallURL("contents/read", Path{NewValue(hash)}, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = rest.Call(uri, nil, &data); err != nil {
+		return nil, err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		return nil, err
+	}
+	if len(data.Result) > 1 {
+		return nil, fmt.Errorf("contents/read %s returned more than one result", hash)
+	}
+	if len(data.Result) == 0 {
+		return nil, fmt.Errorf("unknown contents %s: %w", hash, ErrNotFound)
+	}
+	return data.Result[0], nil
+}
+
+// WriteBlob adds a value to Irmin's contents store without binding it to a path, and returns its hash. Adding the same value again returns the same hash. The value can be garbage collected if it is never referenced from a commit.
+func (rest *Conn) WriteBlob(contents []byte) (string, error) {
+	if err := rest.checkWritable(); err != nil {
+		return "", err
+	}
+	var data blobAddReply
+	var err error
+
+	var body postRequest
+	i := Value(contents)
+	if body.Data, err = i.MarshalJSON(); err != nil {
+		return "", err
+	}
+	body.Task = rest.NewTask("add contents")
+
+	uri, err := rest.MakeCallURL("contents/add", Path{}, false)
+	if err != nil {
+		return "", err
+	}
+	if err = rest.Call(uri, &body, &data); err != nil {
+		return "", err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		return "", err
+	}
+	if data.Result.String() == "" {
+		return "", fmt.Errorf("contents/add seemed to succeed, but didn't return a hash")
+	}
+	return data.Result.String(), nil
+}
@@ -0,0 +1,40 @@
+//go:build charset
+
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+// ReadStringWithEncoding needs golang.org/x/text, so it is only built with -tags charset.
+
+package irmin
+
+import (
+	"fmt"
+
+	"golang.org/x/text/encoding"
+)
+
+// ReadStringWithEncoding reads a value stored in the character encoding enc (e.g. charmap.ISO8859_1) and returns it as a UTF-8 string. Use ReadString for values that are already UTF-8.
+func (rest *Conn) ReadStringWithEncoding(path Path, enc encoding.Encoding) (string, error) {
+	res, err := rest.Read(path)
+	if err != nil {
+		return "", err
+	}
+	s, err := enc.NewDecoder().Bytes(res)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode %s: %s", path.String(), err)
+	}
+	return string(s), nil
+}
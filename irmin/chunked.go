@@ -0,0 +1,159 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	chunkedFormat  = "irmin-go-chunked"
+	chunkedVersion = 1
+	chunkDir       = ".chunks"
+)
+
+// chunkManifest is stored in place of a value written with UpdateChunked
+type chunkManifest struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	Size      int64  `json:"size"`
+	ChunkSize int    `json:"chunk_size"`
+	Chunks    int    `json:"chunks"`
+	ID        string `json:"id"` // the chunks are stored below <path>/.chunks/<id>
+}
+
+// chunkPrefix returns the key the chunks of an upload with the given id are stored below
+func chunkPrefix(path Path, id string) Path {
+	p := make(Path, len(path), len(path)+3)
+	copy(p, path)
+	return append(p, Value(chunkDir), Value(id))
+}
+
+// chunkPath returns the key chunk i of an upload is stored in
+func chunkPath(path Path, id string, i int) Path {
+	return append(chunkPrefix(path, id), Value(strconv.Itoa(i)))
+}
+
+// newChunkID returns a random id for the chunks of an upload
+func newChunkID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand should never fail
+	}
+	return hex.EncodeToString(b)
+}
+
+// readManifest returns the chunk manifest stored at path
+func readManifest(path Path, b []byte) (chunkManifest, error) {
+	var m chunkManifest
+	if err := json.Unmarshal(b, &m); err != nil || m.Format != chunkedFormat {
+		return m, fmt.Errorf("%s is not a chunked value", path.String())
+	}
+	if m.Version != chunkedVersion {
+		return m, fmt.Errorf("%s: unsupported chunked value version %d (expected %d)", path.String(), m.Version, chunkedVersion)
+	}
+	return m, nil
+}
+
+// UpdateChunked writes a value that is too large for a single request. Irmin can't assemble chunks server-side, so r is split into chunks of chunkSize bytes that are stored at <path>/.chunks/<id>/0, <path>/.chunks/<id>/1 etc, where id is chosen at random for each upload. When all chunks have been written, a JSON manifest with the format name, a format version, the total size, the chunk size, the number of chunks and the id is written to path, and the hash of that commit is returned. Each chunk is written with a separate commit, and as the chunks of an upload are never overwritten, readers see the previous value until the manifest is written. The chunks of the value the manifest replaced are removed afterwards; if that fails the error is logged and the new value is still returned. Use ReadChunked to read the value back.
+func (rest *Conn) UpdateChunked(t Task, path Path, r io.Reader, chunkSize int) (string, error) {
+	if err := rest.checkWritable(); err != nil {
+		return "", err
+	}
+	if chunkSize <= 0 {
+		return "", fmt.Errorf("update %s: invalid chunk size %d", path.String(), chunkSize)
+	}
+	m := chunkManifest{Format: chunkedFormat, Version: chunkedVersion, ChunkSize: chunkSize, ID: newChunkID()}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, uerr := rest.Update(t, chunkPath(path, m.ID, m.Chunks), buf[:n]); uerr != nil {
+				return "", uerr
+			}
+			m.Chunks++
+			m.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	old, found, err := rest.TryRead(path)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return "", err
+	}
+	hash, err := rest.Update(t, path, b)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return hash, nil
+	}
+	if prev, err := readManifest(path, old); err == nil && prev.ID != "" && prev.ID != m.ID {
+		if err := rest.RemoveRec(t, chunkPrefix(path, prev.ID)); err != nil {
+			rest.log.Printf("unable to remove previous chunks of %s: %s\n", path.String(), err)
+		}
+	}
+	return hash, nil
+}
+
+// ReadChunked reads a value written with UpdateChunked and writes it to w one chunk at a time. The manifest and the chunks are read from the same commit, so a concurrent UpdateChunked does not affect the result. Returns the number of bytes written. An error is returned if the key does not contain a chunk manifest or a chunk is missing.
+func (rest *Conn) ReadChunked(path Path, w io.Writer) (int64, error) {
+	head, err := rest.Head()
+	if err != nil {
+		return 0, err
+	}
+	at := rest.AtCommit(hex.EncodeToString(head))
+	b, err := at.Read(path)
+	if err != nil {
+		return 0, err
+	}
+	m, err := readManifest(path, b)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	for i := 0; i < m.Chunks; i++ {
+		c, err := at.Read(chunkPath(path, m.ID, i))
+		if err != nil {
+			return written, fmt.Errorf("chunk %d of %s: %w", i, path.String(), err)
+		}
+		n, err := w.Write(c)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if written != m.Size {
+		return written, fmt.Errorf("%s: read %d bytes, expected %d", path.String(), written, m.Size)
+	}
+	return written, nil
+}
@@ -17,79 +17,362 @@
 package irmin
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type client struct {
-	baseURI *url.URL
-	log     Log
+	baseURI           *url.URL
+	servers           *serverList // set by CreateFailover
+	log               Log
+	httpClient        *http.Client
+	maxResponseBytes  int64
+	compressThreshold int
+	maxRetries        int
+	onRequestBody     func(command string, body []byte)
+	idempotencyKeys   bool
+	envelope          EnvelopeEncoder
+	contentType       string // defaults to application/json
+	decoders          map[string]ReplyDecoder
+}
+
+// ReplyDecoder decodes the body of a reply to a non-streaming command into v, which points to the reply struct of the method being called. The reply structs decode the standard Irmin reply, { "result": ..., "error": ..., "version": ... }, so a decoder for a near-compatible server usually rewrites the body into that shape and passes it to json.Unmarshal.
+type ReplyDecoder func(body []byte, v interface{}) error
+
+// EnvelopeEncoder encodes the task, the command parameters and the explicit parents of the new commit, if any, into the body of a POST request. The default is a JSON object with the fields "task", "params" and "parents". An encoder must not drop the parents, or commits written with UpdateWithParents and CompareAndSetWithParents get the current head as parent instead. The task is passed as a pointer so that json.Marshal(t) uses the MarshalJSON method of its values.
+type EnvelopeEncoder func(t *Task, params json.RawMessage, parents []string) ([]byte, error)
+
+// serverList is a list of servers to fail over between. It is shared by all copies of a connection.
+type serverList struct {
+	mu     sync.Mutex
+	uris   []*url.URL
+	active int
+}
+
+// current returns the active server
+func (s *serverList) current() *url.URL {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uris[s.active]
+}
+
+// next makes the server after failed the active one, unless another request already switched away from failed. Returns the new active server.
+func (s *serverList) next(failed *url.URL) *url.URL {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uris[s.active] == failed {
+		s.active = (s.active + 1) % len(s.uris)
+	}
+	return s.uris[s.active]
 }
 
 type streamReply struct {
-	Error  Value
+	Stream Value // set in the start and end tokens
+	Error  errorValue
 	Result json.RawMessage
+	err    error // set in the last reply if the stream failed
 }
 
 func NewClient(uri *url.URL, log Log) *client {
-	return &client{uri, log}
+	return &client{baseURI: uri, log: log}
 }
 
-// Call connects to the specified URL and attempts to unmarshal the reply. The result is stored in v.
-func (c *client) Call(uri *url.URL, post *postRequest, v interface{}) (err error) {
-	c.log.Printf("calling: %s\n", uri.String())
-	var res *http.Response
-	if post == nil {
-		res, err = http.Get(uri.String())
-	} else {
-		j, err := json.Marshal(post)
+// maxRetryDelay is the longest time to wait before retrying a request
+const maxRetryDelay = time.Minute
+
+// do sends a GET request to the URL, or a POST request if post is set. All requests are sent through the configured http.Client. If retries are enabled, GET requests that fail with 503 Service Unavailable are retried after the delay given by the Retry-After header. POST requests are only retried or failed over if they carry an idempotency key.
+func (c *client) do(uri *url.URL, post *postRequest) (*http.Response, error) {
+	return c.doContext(context.Background(), uri, post)
+}
+
+// doContext is like do, but the request is cancelled when ctx is done
+func (c *client) doContext(ctx context.Context, uri *url.URL, post *postRequest) (*http.Response, error) {
+	var body []byte
+	if post != nil {
+		var j []byte
+		var err error
+		if c.envelope != nil {
+			j, err = c.envelope(&post.Task, post.Data, post.Parents)
+		} else {
+			j, err = json.Marshal(post)
+		}
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		if c.onRequestBody != nil {
+			c.onRequestBody(commandFromURL(uri), j)
 		}
-		c.log.Printf("post body: %s\n", j)
-		res, err = http.Post(uri.String(), "application/json", bytes.NewBuffer(j))
+		body = j
+	}
+
+	// The same key is sent with every attempt, so the server can detect a retried write that has already been applied
+	key := ""
+	if post != nil && c.idempotencyKeys {
+		key = newIdempotencyKey()
+	}
+	idempotent := post == nil || key != ""
+
+	failovers, retries := 0, 0
+	for {
+		res, err := c.send(ctx, uri, post != nil, body, key)
+		if err != nil {
+			// Only requests without side effects can safely be sent to another server
+			if c.servers == nil || !idempotent || failovers >= len(c.servers.uris)-1 {
+				return nil, err
+			}
+			failovers++
+			srv := c.servers.next(c.serverFor(uri))
+			c.log.Printf("failover %d of %d: %s failed: %s, switching to %s\n", failovers, len(c.servers.uris)-1, uri.String(), err, srv.String())
+			uri = rebase(uri, srv)
+			continue
+		}
+		if res.StatusCode != http.StatusServiceUnavailable || !idempotent || retries >= c.maxRetries {
+			return res, nil
+		}
+		retries++
+		delay := retryDelay(res.Header.Get("Retry-After"), retries)
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		c.log.Printf("retry %d of %d: %s returned %s, retrying in %s\n", retries, c.maxRetries, uri.String(), res.Status, delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// commandFromURL returns the name of the Irmin command called by uri, without the tree prefix and key path. For view commands this is "view".
+func commandFromURL(uri *url.URL) string {
+	segs := strings.Split(strings.TrimPrefix(uri.Path, "/"), "/")
+	if len(segs) > 2 && segs[0] == "tree" {
+		segs = segs[2:]
+	}
+	return segs[0]
+}
+
+// base returns the URL of the server requests are currently sent to
+func (c *client) base() *url.URL {
+	if c.servers != nil {
+		return c.servers.current()
+	}
+	return c.baseURI
+}
+
+// initialized returns ErrNotInitialized if the client is a zero value, e.g. a Conn that was not created with Create
+func (c *client) initialized() error {
+	if c.log == nil || c.base() == nil {
+		return ErrNotInitialized
+	}
+	return nil
+}
+
+// serverFor returns the server in the failover list that uri points to
+func (c *client) serverFor(uri *url.URL) *url.URL {
+	for _, srv := range c.servers.uris {
+		if srv.Scheme == uri.Scheme && srv.Host == uri.Host {
+			return srv
+		}
+	}
+	return nil
+}
+
+// rebase returns a copy of uri pointing to srv
+func rebase(uri *url.URL, srv *url.URL) *url.URL {
+	u := *uri
+	u.Scheme = srv.Scheme
+	u.Host = srv.Host
+	u.User = srv.User
+	return &u
+}
+
+// newIdempotencyKey returns a random key for the Idempotency-Key header
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand should never fail
 	}
+	return hex.EncodeToString(b)
+}
+
+// send sends a single request. body is sent with POST if post is true, with an Idempotency-Key header if key is set.
+func (c *client) send(ctx context.Context, uri *url.URL, post bool, body []byte, key string) (*http.Response, error) {
+	hc := c.httpClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	if !post {
+		req, err := http.NewRequestWithContext(ctx, "GET", uri.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return hc.Do(req)
+	}
+
+	var r io.Reader = bytes.NewReader(body)
+	compressed := c.compressThreshold > 0 && len(body) >= c.compressThreshold
+	if compressed {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		r = &buf
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", uri.String(), r)
 	if err != nil {
-		return
+		return nil, err
+	}
+	contentType := c.contentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	return hc.Do(req)
+}
+
+// retryDelay returns how long to wait before a retry. The Retry-After header may contain a number of seconds or an HTTP date. Without a valid header the delay doubles with each attempt, starting at one second.
+func retryDelay(retryAfter string, attempt int) time.Duration {
+	var d time.Duration
+	if secs, err := strconv.Atoi(strings.TrimSpace(retryAfter)); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(retryAfter); err == nil {
+		d = time.Until(t)
+	} else {
+		d = time.Second << uint(attempt-1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// Call connects to the specified URL and attempts to unmarshal the reply. The result is stored in v.
+func (c *client) Call(uri *url.URL, post *postRequest, v interface{}) error {
+	_, err := c.call(uri, post, v)
+	return err
+}
+
+// call is like Call, but also returns the HTTP response. The body of the response has already been read and closed.
+func (c *client) call(uri *url.URL, post *postRequest, v interface{}) (*http.Response, error) {
+	res, body, err := c.callRaw(uri, post)
+	if err != nil {
+		return res, err
+	}
+	return res, c.decodeReply(uri, res, body, v)
+}
+
+// decodeReply decodes the body of a reply received with callRaw into v, with the decoder set for the command with SetReplyDecoder or encoding/json
+func (c *client) decodeReply(uri *url.URL, res *http.Response, body []byte, v interface{}) error {
+	if res.StatusCode == http.StatusNotFound {
+		return statusError(uri, res)
+	}
+	decode := json.Unmarshal
+	if dec, ok := c.decoders[commandFromURL(uri)]; ok {
+		decode = dec
+	}
+	if err := decode(body, v); err != nil {
+		if res.StatusCode >= 300 { // Irmin reports most errors in the body, so only fail on the status if there is no reply
+			return statusError(uri, res)
+		}
+		return err
+	}
+	return nil
+}
+
+// statusError returns an error for an unsuccessful HTTP status. 404 Not Found is reported as ErrNotFound, as some servers use it instead of an empty result for missing keys.
+func statusError(uri *url.URL, res *http.Response) error {
+	if res.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %s: %w", uri.String(), res.Status, ErrNotFound)
+	}
+	return fmt.Errorf("%s: unexpected status %s", uri.String(), res.Status)
+}
+
+// callRaw sends a request and returns the response with its body, which has already been read and closed. The body is not decoded and the status is not checked.
+func (c *client) callRaw(uri *url.URL, post *postRequest) (*http.Response, []byte, error) {
+	if err := c.initialized(); err != nil {
+		return nil, nil, err
+	}
+	c.log.Printf("calling: %s\n", uri.String())
+	res, err := c.do(uri, post)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	var r io.Reader = res.Body
+	if c.maxResponseBytes > 0 {
+		r = io.LimitReader(res.Body, c.maxResponseBytes+1)
+	}
+	body, err := ioutil.ReadAll(r)
 	if err != nil {
-		return
+		return res, nil, err
+	}
+	if c.maxResponseBytes > 0 && int64(len(body)) > c.maxResponseBytes {
+		return res, nil, fmt.Errorf("response from %s is larger than %d bytes", uri.String(), c.maxResponseBytes)
 	}
 	c.log.Printf("returned: %s\n", body)
+	return res, body, nil
+}
 
-	return json.Unmarshal(body, v)
+// CallStream connects to the given URL and returns a channel with responses until the stream is closed. The stream may be a JSON array or, if the server replies with Content-Type text/event-stream, server-sent events with one element per event. The channel contains raw replies and must be unmarshaled by the caller. If the stream fails, ends without an end token or the server reports an error in a frame, the last reply has no result and its err field is set.
+func (rest *Conn) CallStream(uri *url.URL, post *postRequest) (<-chan *streamReply, error) {
+	return rest.callStream(context.Background(), uri, post)
 }
 
-// CallStream connects to the given URL and returns a channel with responses until the stream is closed. The channel contains raw replies and must be unmarshaled by the caller.
-func (c *Conn) CallStream(uri *url.URL, post *postRequest) (_ <-chan *streamReply, err error) {
+// callStream is like CallStream, but the stream is closed when ctx is done
+func (rest *Conn) callStream(ctx context.Context, uri *url.URL, post *postRequest) (_ <-chan *streamReply, err error) {
 	var streamToken struct {
 		Stream Value
 	}
 	var version struct {
-		Version Value
+		Version json.RawMessage
 	}
 
-	var res *http.Response
-
-	if post == nil {
-		res, err = http.Get(uri.String())
-	} else {
-		j, err := json.Marshal(post)
-		if err != nil {
-			panic(err)
-		}
-		res, err = http.Post(uri.String(), "application/json", bytes.NewBuffer(j))
+	if err = rest.initialized(); err != nil {
+		return
 	}
+	res, err := rest.doContext(ctx, uri, post)
 	if err != nil {
 		return
 	}
+	if res.StatusCode >= 300 { // not a stream
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		return nil, statusError(uri, res)
+	}
 
+	// The body is closed once both this function and the decoding goroutine are done with it.
+	// The goroutine stops at the end of the stream, on a decode error (including the one caused
+	// by ctx cancelling the request), or when ctx is done while it waits for the consumer, so
+	// cancelling ctx releases the connection even if the channel is never drained.
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	defer wg.Done()
@@ -98,19 +381,60 @@ func (c *Conn) CallStream(uri *url.URL, post *postRequest) (_ <-chan *streamRepl
 		res.Body.Close()
 	}()
 
-	dec := json.NewDecoder(res.Body)
-	if _, err = dec.Token(); err != nil { // read [ token
-		return
-	}
+	var next func() (*streamReply, error) // returns io.EOF if the body ends
+	if isEventStream(res) {
+		next = sseFrames(res.Body)
+	} else {
+		body := &eofReader{r: res.Body}
+		dec := json.NewDecoder(body)
+		if _, err = dec.Token(); err != nil { // read [ token
+			return
+		}
 
-	err = dec.Decode(&streamToken)
-	if err != nil || !bytes.Equal(streamToken.Stream, []byte("start")) { // look for stream start
-		return
-	}
+		err = dec.Decode(&streamToken)
+		if err != nil || !bytes.Equal(streamToken.Stream, []byte("start")) { // look for stream start
+			return
+		}
 
-	err = dec.Decode(&version)
-	if err != nil {
-		return
+		var first *streamReply // set if the server did not send a version frame
+		if dec.More() {
+			var raw json.RawMessage
+			if err = dec.Decode(&raw); err != nil {
+				return
+			}
+			if err = json.Unmarshal(raw, &version); err != nil {
+				return
+			}
+			if version.Version == nil { // not a version frame, so it is the first element
+				first = new(streamReply)
+				if err = json.Unmarshal(raw, first); err != nil {
+					return
+				}
+			}
+		}
+
+		next = func() (*streamReply, error) {
+			if first != nil {
+				s := first
+				first = nil
+				return s, nil
+			}
+			if !dec.More() { // closing ] or a read error
+				tok, err := dec.Token()
+				if err != nil {
+					return nil, body.truncated(err)
+				}
+				if tok != json.Delim(']') {
+					return nil, fmt.Errorf("unexpected %v in stream", tok)
+				}
+				return nil, io.EOF
+			}
+			s := new(streamReply)
+			if err := dec.Decode(s); err != nil {
+				return nil, body.truncated(err)
+			}
+			return s, nil
+		}
 	}
 
 	ch := make(chan *streamReply, 100)
@@ -121,17 +445,158 @@ func (c *Conn) CallStream(uri *url.URL, post *postRequest) (_ <-chan *streamRepl
 			wg.Done()
 		}()
 
-		for dec.More() {
-			s := new(streamReply)
-			if err = dec.Decode(s); err != nil {
+		for {
+			s, err := next()
+			if err == io.EOF { // a truncated body, or the server closed the stream without an end token
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				select { // report the error unless it was caused by closing the stream
+				case ch <- &streamReply{err: fmt.Errorf("%s: stream error: %w", uri.String(), err)}:
+				case <-ctx.Done():
+				}
 				return
 			}
-			if len(s.Result) == 0 { // If result is empty, look for stream end
-				if err = dec.Decode(&streamToken); err != nil || bytes.Equal(streamToken.Stream, []byte("end")) { // look for stream end
-					return
+			if bytes.Equal(s.Stream, []byte("end")) { // only an explicit end token ends the stream
+				return
+			}
+			if s.Error.Message != "" || s.Error.Code != "" { // a server-reported error ends the stream
+				select {
+				case ch <- &streamReply{err: fmt.Errorf("%s: stream error: %w", uri.String(), rest.replyError(s.Error))}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if s.Result == nil { // an empty value still has a result field, so this is not a data frame
+				rest.log.Printf("%s: ignoring unexpected stream element\n", uri.String())
+				continue
+			}
+			select {
+			case ch <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// eofReader records how much of the underlying reader has been read and whether it has reached the end
+type eofReader struct {
+	r   io.Reader
+	n   int64
+	eof bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.n += int64(n)
+	if err == io.EOF {
+		e.eof = true
+	}
+	return n, err
+}
+
+// truncated returns io.ErrUnexpectedEOF if a decode error was caused by reaching the end of the body, and err otherwise
+func (e *eofReader) truncated(err error) error {
+	var serr *json.SyntaxError
+	switch {
+	case !e.eof:
+		return err
+	case err == io.EOF, err == io.ErrUnexpectedEOF:
+		return io.ErrUnexpectedEOF
+	case errors.As(err, &serr) && serr.Offset >= e.n: // the decoder ran out of input
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// isEventStream returns true if the server sent the stream as server-sent events instead of a JSON array
+func isEventStream(res *http.Response) bool {
+	return strings.HasPrefix(strings.ToLower(res.Header.Get("Content-Type")), "text/event-stream")
+}
+
+// sseFrames returns a function that reads the next frame from a server-sent event stream. Each event carries one element of the JSON stream in its data lines. Other fields and comments are ignored, and so are the start and version frames, which only matter for the JSON array framing.
+func sseFrames(r io.Reader) func() (*streamReply, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxRawFrameSize)
+	return func() (*streamReply, error) {
+		var data []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line != "" {
+				if strings.HasPrefix(line, "data:") {
+					data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
 				}
+				continue
+			}
+			if len(data) == 0 { // empty event
+				continue
+			}
+			var frame struct {
+				streamReply
+				Version *Value
+			}
+			if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &frame); err != nil {
+				return nil, err
+			}
+			data = nil
+			if bytes.Equal(frame.Stream, []byte("start")) || (frame.Version != nil && frame.Result == nil) {
+				continue
 			}
-			ch <- s
+			return &frame.streamReply, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF // an incomplete last event is discarded
+	}
+}
+
+// maxRawFrameSize is the largest frame CallRawStream accepts
+const maxRawFrameSize = 16 * 1024 * 1024
+
+// CallRawStream connects to the given URL and returns a channel with the frames of the response body until the stream is closed. The body is not decoded as JSON, but split into frames by split (e.g. bufio.ScanLines). This can be used for streaming commands that do not use the JSON stream format. The stream is only closed when the body ends; use CallRawStreamContext to stop reading early.
+func (rest *Conn) CallRawStream(uri *url.URL, post *postRequest, split bufio.SplitFunc) (<-chan []byte, error) {
+	return rest.CallRawStreamContext(context.Background(), uri, post, split)
+}
+
+// CallRawStreamContext is like CallRawStream, but the stream is closed when ctx is done, so a consumer that stops reading must cancel ctx to release the connection.
+func (rest *Conn) CallRawStreamContext(ctx context.Context, uri *url.URL, post *postRequest, split bufio.SplitFunc) (<-chan []byte, error) {
+	if err := rest.initialized(); err != nil {
+		return nil, err
+	}
+	res, err := rest.doContext(ctx, uri, post)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		return nil, statusError(uri, res)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(nil, maxRawFrameSize)
+	scanner.Split(split)
+
+	ch := make(chan []byte, 100)
+	go func() {
+		defer func() {
+			close(ch)
+			res.Body.Close()
+		}()
+		for scanner.Scan() {
+			frame := make([]byte, len(scanner.Bytes())) // the scanner reuses its buffer
+			copy(frame, scanner.Bytes())
+			select {
+			case ch <- frame:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			rest.log.Printf("raw stream from %s closed: %s\n", uri.String(), err)
 		}
 	}()
 	return ch, nil
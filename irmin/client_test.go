@@ -0,0 +1,375 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testConn returns a connection to a test server that replies with handler
+func testConn(t *testing.T, handler http.HandlerFunc) *Conn {
+	t.Helper()
+	s := httptest.NewServer(handler)
+	t.Cleanup(s.Close)
+	uri, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Create(uri, "test")
+}
+
+// testStream returns a handler that replies with body for every request
+func testStream(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestStreamEmptyValue(t *testing.T) {
+	c := testConn(t, testStream(`[{"stream":"start"},{"version":"0.9"},`+
+		`{"result":[["aa","x"]]},{"result":[["bb",""]]},{"result":[["cc","z"]]},{"stream":"end"}]`))
+	ch, err := c.Watch(ParsePath("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for r := range ch {
+		values = append(values, string(r.Value))
+	}
+	if fmt.Sprint(values) != fmt.Sprint([]string{"x", "", "z"}) {
+		t.Fatalf("got values %q, expected the empty value to be delivered", values)
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	for _, body := range []string{
+		`[{"stream":"start"},{"version":"0.9"},{"result":["a"]},{"result":["b"]},{"res`,
+		`[{"stream":"start"},{"version":"0.9"},{"result":["a"]},{"result":["b"]}`,
+		`[{"stream":"start"},{"version":"0.9"},{"result":["a"]},{"result":["b"]}]`, // no end token
+	} {
+		c := testConn(t, testStream(body))
+		ch, err := c.IterResults(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		var last error
+		for r := range ch {
+			if r.Err != nil {
+				last = r.Err
+				continue
+			}
+			paths = append(paths, r.Path.String())
+		}
+		if len(paths) != 2 || !errors.Is(last, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: got %q and error %v, expected 2 paths and io.ErrUnexpectedEOF", body, paths, last)
+		}
+	}
+}
+
+func TestStreamInvalid(t *testing.T) {
+	c := testConn(t, testStream(`[{"stream":"start"},{"version":"0.9"},{"result":["a"]},}`))
+	ch, err := c.IterResults(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last error
+	for r := range ch {
+		last = r.Err
+	}
+	if last == nil || errors.Is(last, io.ErrUnexpectedEOF) {
+		t.Fatalf("got error %v, expected a syntax error", last)
+	}
+}
+
+func TestStreamErrorFrame(t *testing.T) {
+	c := testConn(t, testStream(`[{"stream":"start"},{"version":"0.9"},{"result":["a"]},`+
+		`{"error":{"code":"conflict","message":"conflict"}},{"result":["b"]},{"stream":"end"}]`))
+	ch, err := c.IterResults(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []PathResult
+	for r := range ch {
+		got = append(got, r)
+	}
+	if len(got) != 2 || got[0].Err != nil || got[1].Err == nil {
+		t.Fatalf("got %v, expected one path followed by the error", got)
+	}
+	if !errors.Is(got[1].Err, ErrConflict) {
+		t.Fatalf("got error %v, expected ErrConflict", got[1].Err)
+	}
+}
+
+// endlessStream returns a handler that sends frame(i) for i = 0, 1, ... until the client goes away
+func endlessStream(frame func(i int) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"stream":"start"},{"version":"0.9"}`)
+		for i := 0; ; i++ {
+			if _, err := fmt.Fprintf(w, ",%s", frame(i)); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+}
+
+// waitForGoroutines waits until at most n goroutines are running and returns the number running
+func waitForGoroutines(n int) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := runtime.NumGoroutine()
+		if got <= n || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamCancelNoLeak(t *testing.T) {
+	// each stream is cancelled before it is read, and must then be closed
+	streams := map[string]func(c *Conn, ctx context.Context, cancel func()) error{
+		"IterResults": func(c *Conn, ctx context.Context, cancel func()) error {
+			ch, err := c.IterResults(ctx)
+			if err != nil {
+				return err
+			}
+			time.Sleep(5 * time.Millisecond) // let some frames arrive
+			cancel()
+			for range ch {
+			}
+			return nil
+		},
+		"CallRawStreamContext": func(c *Conn, ctx context.Context, cancel func()) error {
+			uri, err := c.MakeCallURL("iter", Path{}, true)
+			if err != nil {
+				return err
+			}
+			ch, err := c.CallRawStreamContext(ctx, uri, nil, bufio.ScanRunes)
+			if err != nil {
+				return err
+			}
+			time.Sleep(5 * time.Millisecond)
+			cancel()
+			for range ch {
+			}
+			return nil
+		},
+		"Tail": func(c *Conn, ctx context.Context, cancel func()) error {
+			ch, err := c.Tail(ctx)
+			if err != nil {
+				return err
+			}
+			time.Sleep(5 * time.Millisecond)
+			cancel()
+			for range ch {
+			}
+			return nil
+		},
+	}
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/iter":
+			endlessStream(func(i int) string { return fmt.Sprintf(`{"result":["k%d"]}`, i) })(w, r)
+		case "/watch-rec":
+			endlessStream(func(i int) string { return fmt.Sprintf(`{"result":["abcd",[["Created",["k%d"]]]]}`, i) })(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	tr := &http.Transport{}
+	c.SetTransport(tr)
+
+	for name, stream := range streams {
+		before := runtime.NumGoroutine()
+		for i := 0; i < 10; i++ {
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- stream(c, ctx, cancel) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: channel not closed after cancelling the context", name)
+			}
+			cancel()
+		}
+		tr.CloseIdleConnections()
+		if after := waitForGoroutines(before); after > before {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%s: %d goroutines before, %d after cancelling 10 streams:\n%s", name, before, after, buf[:runtime.Stack(buf, true)])
+		}
+	}
+}
+
+func TestStreamVersionFrame(t *testing.T) {
+	for _, body := range []string{
+		`[{"stream":"start"},{"version":"0.9"},{"result":["a"]},{"result":["b"]},{"stream":"end"}]`,
+		`[{"stream":"start"},{"result":["a"]},{"result":["b"]},{"stream":"end"}]`,
+	} {
+		c := testConn(t, testStream(body))
+		ch, err := c.IterResults(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for r := range ch {
+			if r.Err != nil {
+				t.Fatalf("%s: %s", body, r.Err)
+			}
+			paths = append(paths, r.Path.String())
+		}
+		if fmt.Sprint(paths) != "[/a /b]" {
+			t.Errorf("%s: got %q, expected /a and /b", body, paths)
+		}
+	}
+
+	// a stream with only a version frame is empty
+	c := testConn(t, testStream(`[{"stream":"start"},{"version":"0.9"},{"stream":"end"}]`))
+	ch, err := c.IterResults(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r := range ch {
+		t.Errorf("unexpected result %v", r)
+	}
+}
+
+func TestListAllTruncated(t *testing.T) {
+	c := testConn(t, testStream(`[{"stream":"start"},{"version":"0.9"},{"result":["a"]},{"result":["b"]},{"res`))
+	paths, err := c.ListAll(0)
+	if len(paths) != 2 || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v, %v, expected 2 paths and io.ErrUnexpectedEOF", paths, err)
+	}
+}
+
+func TestCountTruncated(t *testing.T) {
+	c := testConn(t, testStream(`[{"stream":"start"},{"version":"0.9"},{"result":["a"]},{"result":["b"]},{"res`))
+	if n, err := c.Count(Path{}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %d, %v, expected io.ErrUnexpectedEOF", n, err)
+	}
+}
+
+func TestWatchPathInvalidFrame(t *testing.T) {
+	for _, frame := range []string{
+		`{"result":"x"}`,
+		`{"result":["abcd"]}`,
+		`{"result":[1,[]]}`,
+		`{"result":["abcd",[["Created"]]]}`,
+		`{"result":["abcd",[[1,["k"]]]]}`,
+	} {
+		c := testConn(t, testStream(`[{"stream":"start"},{"version":"0.9"},{"result":["abcd",[["Created",["a"]]]]},`+
+			frame+`,{"result":["abcd",[["Created",["b"]]]]},{"stream":"end"}]`))
+		ch, err := c.Tail(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for r := range ch {
+			keys = append(keys, r.Key.String())
+		}
+		if fmt.Sprint(keys) != "[/a]" {
+			t.Errorf("%s: got %q, expected the stream to close after /a", frame, keys)
+		}
+	}
+}
+
+func TestWatchInvalidFrame(t *testing.T) {
+	for _, frame := range []string{
+		`{"result":"x"}`,
+		`{"result":[["abcd"]]}`,
+		`{"result":[["abcd","x","y"]]}`,
+	} {
+		c := testConn(t, testStream(`[{"stream":"start"},{"version":"0.9"},{"result":[["abcd","a"]]},`+
+			frame+`,{"result":[["abcd","b"]]},{"stream":"end"}]`))
+		ch, err := c.Watch(ParsePath("k"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for r := range ch {
+			values = append(values, string(r.Value))
+		}
+		if fmt.Sprint(values) != "[a]" {
+			t.Errorf("%s: got %q, expected the stream to close after a", frame, values)
+		}
+
+		// WatchOnce (and WaitUntil) report a closed stream as an error
+		c = testConn(t, testStream(`[{"stream":"start"},{"version":"0.9"},`+frame+`,{"stream":"end"}]`))
+		if r, err := c.WatchOnce(context.Background(), ParsePath("k")); err == nil {
+			t.Errorf("%s: got %v from WatchOnce, expected an error", frame, r)
+		}
+	}
+}
+
+func TestIterLargeStream(t *testing.T) {
+	const keys = 100000 // about 12MB of frames
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		bw := bufio.NewWriter(w)
+		fmt.Fprint(bw, `[{"stream":"start"},{"version":"0.9"}`)
+		for i := 0; i < keys; i++ {
+			fmt.Fprintf(bw, `,{"result":["dir","key-%0100d"]}`, i)
+		}
+		fmt.Fprint(bw, `,{"stream":"end"}]`)
+		bw.Flush()
+	})
+	ch, err := c.Iter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ms runtime.MemStats
+	n := 0
+	var start uint64
+	for p := range ch {
+		if len(*p) != 2 {
+			t.Fatalf("got %v", *p)
+		}
+		n++
+		switch n {
+		case keys / 10: // after the buffers have been allocated
+			runtime.GC()
+			runtime.ReadMemStats(&ms)
+			start = ms.HeapAlloc
+		case keys - 1:
+			runtime.GC()
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > start+4<<20 {
+				t.Errorf("heap grew from %d to %d bytes while iterating", start, ms.HeapAlloc)
+			}
+		}
+	}
+	if n != keys {
+		t.Fatalf("got %d keys, expected %d", n, keys)
+	}
+}
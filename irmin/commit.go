@@ -0,0 +1,320 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// commitValue is a commit object as stored by Irmin
+type commitValue struct {
+	Node    Value   `json:"node"`
+	Parents []Value `json:"parents"`
+	Task    Task    `json:"task"`
+}
+
+// Commit describes a commit in Irmin
+type Commit struct {
+	Hash    string   // hash of the commit
+	Node    string   // hash of the root node of the commit
+	Parents []string // hashes of the parent commits
+	Task    Task     // task (commit message)
+}
+
+type commitReadReply struct {
+	Result  *commitValue
+	Error   errorValue
+	Version Value
+}
+
+// readCommit reads a commit object from the commit store
+func (rest *Conn) readCommit(hash string) (*commitValue, error) {
+	var data commitReadReply
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+	uri, err := rest.MakeCallURL("commit/read", Path{NewValue(hash)}, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = rest.Call(uri, nil, &data); err != nil {
+		return nil, err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		return nil, err
+	}
+	if data.Result == nil {
+		return nil, fmt.Errorf("unknown commit %s: %w", hash, ErrNotFound)
+	}
+	return data.Result, nil
+}
+
+// GetCommit reads a commit by its hash. Returns ErrNotFound if the commit does not exist.
+func (rest *Conn) GetCommit(hash string) (Commit, error) {
+	c, err := rest.readCommit(hash)
+	if err != nil {
+		return Commit{}, err
+	}
+	r := Commit{Hash: hash, Node: c.Node.String(), Task: c.Task}
+	r.Parents = make([]string, len(c.Parents))
+	for i, p := range c.Parents {
+		r.Parents[i] = p.String()
+	}
+	return r, nil
+}
+
+// WaitForCommit polls Irmin every poll interval until the commit with the given hash can be read, e.g. after it has been replicated from another server. poll must be positive. Returns the context error if ctx is cancelled first.
+func (rest *Conn) WaitForCommit(ctx context.Context, hash string, poll time.Duration) error {
+	if err := validateHash(hash); err != nil {
+		return err
+	}
+	if poll <= 0 {
+		return fmt.Errorf("invalid poll interval %s", poll)
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		_, err := rest.GetCommit(hash)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ancestors returns the hashes of a commit and all commits reachable from it through its parents
+func (rest *Conn) ancestors(hash string) (map[string]bool, error) {
+	seen := map[string]bool{hash: true}
+	queue := []string{hash}
+	for len(queue) > 0 {
+		c, err := rest.GetCommit(queue[0])
+		if err != nil {
+			return nil, err
+		}
+		queue = queue[1:]
+		for _, p := range c.Parents {
+			if !seen[p] {
+				seen[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+	return seen, nil
+}
+
+// AheadBehind returns how many commits branch has that the current tree (master by default) does not have, and how many commits the current tree has that branch does not have. The history of both is read commit by commit, which is slow for long histories. An error is returned if they have no common ancestor.
+func (rest *Conn) AheadBehind(branch string) (ahead, behind int, err error) {
+	head, err := rest.Resolve(branch)
+	if err != nil {
+		return 0, 0, err
+	}
+	baseHead, err := rest.Head()
+	if err != nil {
+		return 0, 0, err
+	}
+	a, err := rest.ancestors(head)
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := rest.ancestors(hex.EncodeToString(baseHead))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	common := 0
+	for h := range a {
+		if b[h] {
+			common++
+		}
+	}
+	if common == 0 {
+		return 0, 0, fmt.Errorf("%s and %s have no common ancestor", branch, rest.treeName())
+	}
+	return len(a) - common, len(b) - common, nil
+}
+
+// ChangedSince returns the keys that were created, updated or removed between commit and the head of the current tree, sorted with SortPaths. This lets a client that recorded the last commit it has seen fetch only the keys that changed. Irmin has no diff command, so the history is read to check that commit is an ancestor of the head, and then the values of all keys at both commits are read and compared, which is slow for large stores. Returns ErrNotFound if the commit does not exist.
+func (rest *Conn) ChangedSince(commit string) ([]Path, error) {
+	if _, err := rest.GetCommit(commit); err != nil {
+		return nil, err
+	}
+	head, err := rest.Head()
+	if err != nil {
+		return nil, err
+	}
+	headHash := hex.EncodeToString(head)
+	if headHash == commit {
+		return []Path{}, nil
+	}
+	reachable, err := rest.ancestors(headHash)
+	if err != nil {
+		return nil, err
+	}
+	if !reachable[commit] {
+		return nil, fmt.Errorf("commit %s is not an ancestor of %s", commit, rest.treeName())
+	}
+
+	before, err := rest.contentHashes(commit)
+	if err != nil {
+		return nil, err
+	}
+	after, err := rest.contentHashes(headHash)
+	if err != nil {
+		return nil, err
+	}
+	changed := []Path{}
+	for k, a := range after {
+		if b, ok := before[k]; !ok || b.hash != a.hash {
+			changed = append(changed, a.path)
+		}
+	}
+	for k, b := range before {
+		if _, ok := after[k]; !ok {
+			changed = append(changed, b.path)
+		}
+	}
+	SortPaths(changed)
+	return changed, nil
+}
+
+type pathHash struct {
+	path Path
+	hash string
+}
+
+// contentHashes returns the content hash of every key at a commit, indexed by the URL encoding of the path
+func (rest *Conn) contentHashes(commit string) (map[string]pathHash, error) {
+	at := rest.AtCommit(commit)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := at.IterResults(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r := map[string]pathHash{}
+	for res := range ch {
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		v, err := at.Read(res.Path)
+		if err != nil {
+			return nil, err
+		}
+		r[res.Path.URL().String()] = pathHash{res.Path, contentHash(v)}
+	}
+	return r, nil
+}
+
+// WatchCommits watches the head of the current tree and returns each new head commit. Irmin reports changes of the head, not every commit, so if several commits land between two notifications only the last one is returned, and commits merged in from other branches are only reachable through its parents. Commits are returned in the order the head moved. Delivery is at-most-once: changes made while the stream is not connected are not reported. Returns ErrUnsupported if the server has no watch-head command. The stream is closed when ctx is done, the connection fails or a commit can't be read.
+func (rest *Conn) WatchCommits(ctx context.Context) (<-chan Commit, error) {
+	ok, err := rest.SupportsCommand("watch-head")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("watch-head: %w", ErrUnsupported)
+	}
+	uri, err := rest.MakeCallURL("watch-head", Path{}, true)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	ch, err := rest.callStream(ctx, uri, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if ch == nil {
+		cancel()
+		return nil, fmt.Errorf("%s: invalid stream from Irmin", uri.String())
+	}
+
+	out := make(chan Commit, 1)
+
+	go func() {
+		defer func() {
+			cancel() // close the stream if we stop early
+			close(out)
+		}()
+		for m := range ch {
+			if m.err != nil {
+				rest.log.Printf("closing watch-head: %s\n", m.err)
+				return
+			}
+			hash := newHead(m.Result)
+			if hash == "" { // the head was removed
+				continue
+			}
+			c, err := rest.GetCommit(hash)
+			if err != nil {
+				rest.log.Printf("closing watch-head: %s\n", err)
+				return
+			}
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// newHead returns the new head in a watch-head result, or "" if there is none. Depending on the version Irmin sends the hash itself or a diff: { "added": new }, { "updated": [old, new] } or { "removed": old }. A removed head has no new hash, so "" is returned for it.
+func newHead(result []byte) string {
+	var hash string
+	if err := json.Unmarshal(result, &hash); err == nil {
+		return validHead(hash)
+	}
+	var diff map[string]json.RawMessage
+	if err := json.Unmarshal(result, &diff); err != nil {
+		return ""
+	}
+	if v, ok := diff["added"]; ok {
+		if err := json.Unmarshal(v, &hash); err == nil {
+			return validHead(hash)
+		}
+	}
+	if v, ok := diff["updated"]; ok {
+		var pair []string
+		if err := json.Unmarshal(v, &pair); err == nil && len(pair) == 2 {
+			return validHead(pair[1])
+		}
+	}
+	return "" // removed, or a diff we don't know
+}
+
+// validHead returns hash if it is a valid commit hash, or ""
+func validHead(hash string) string {
+	if validateHash(hash) != nil {
+		return ""
+	}
+	return hash
+}
@@ -0,0 +1,67 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestNewHead(t *testing.T) {
+	for result, want := range map[string]string{
+		`"abcd"`:                      "abcd",
+		`{"added":"abcd"}`:            "abcd",
+		`{"updated":["0123","abcd"]}`: "abcd",
+		`{"removed":"abcd"}`:          "",
+		`{"updated":["abcd"]}`:        "",
+		`"not a hash"`:                "",
+		`{"other":"abcd"}`:            "",
+	} {
+		if got := newHead([]byte(result)); got != want {
+			t.Errorf("%s: got %q, expected %q", result, got, want)
+		}
+	}
+}
+
+func TestWatchCommitsRemovedHead(t *testing.T) {
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `{"result":["watch-head"],"version":"0.9"}`)
+		case "/watch-head":
+			fmt.Fprint(w, `[{"stream":"start"},{"version":"0.9"},{"result":{"added":"aa"}},`+
+				`{"result":{"removed":"aa"}},{"result":{"updated":["aa","bb"]}},{"stream":"end"}]`)
+		case "/commit/read/aa", "/commit/read/bb":
+			fmt.Fprint(w, `{"result":{"node":"cc","parents":[],"task":{"date":"0","uid":"0","owner":"test","messages":[]}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	ch, err := c.WatchCommits(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var heads []string
+	for commit := range ch {
+		heads = append(heads, commit.Hash)
+	}
+	if fmt.Sprint(heads) != "[aa bb]" {
+		t.Fatalf("got heads %q, expected the removed head to be skipped", heads)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrConflict is returned when Irmin rejects a commit or update because it conflicts with the current state of the store
+var ErrConflict = errors.New("conflict")
+
+// ErrNotFound is returned when a key or object does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrLimitExceeded is returned when a result has more entries than the requested maximum
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// ErrReadOnly is returned by commands that modify the store when the connection is read-only
+var ErrReadOnly = errors.New("connection is read-only")
+
+// ErrRefExists is returned when creating a tag or branch that already exists
+var ErrRefExists = errors.New("ref already exists")
+
+// ErrUnsupported is returned when the Irmin server does not provide the command needed by a method
+var ErrUnsupported = errors.New("command not supported by server")
+
+// ErrNotInitialized is returned when a Conn was not created with Create or one of the other constructors
+var ErrNotInitialized = errors.New("connection not initialized")
+
+// ErrUnknownRef is returned when the tree or branch used by a command does not exist. The returned error is an *UnknownRefError that can be matched with errors.Is.
+var ErrUnknownRef = errors.New("unknown ref")
+
+// UnknownRefError is returned when Irmin reports that the tree or branch used by a command does not exist
+type UnknownRefError struct {
+	Ref string // name of the tree or branch
+	Msg string // error message from Irmin
+}
+
+func (e *UnknownRefError) Error() string {
+	return fmt.Sprintf("unknown ref %s: %s", e.Ref, e.Msg)
+}
+
+// Is reports whether target is ErrUnknownRef
+func (e *UnknownRefError) Is(target error) bool {
+	return target == ErrUnknownRef
+}
+
+// MergeConflictError is returned by Merge when the branches can't be merged. It can be matched with errors.Is(err, ErrConflict).
+type MergeConflictError struct {
+	Branch string // branch that was merged into the current tree
+	Paths  []Path // keys that conflicted, if the server reported them
+	Msg    string // error message from Irmin
+}
+
+func (e *MergeConflictError) Error() string {
+	if len(e.Paths) == 0 {
+		return fmt.Sprintf("merge %s: conflict: %s", e.Branch, e.Msg)
+	}
+	paths := make([]string, len(e.Paths))
+	for i := range e.Paths {
+		paths[i] = e.Paths[i].String()
+	}
+	return fmt.Sprintf("merge %s: conflict in %s: %s", e.Branch, strings.Join(paths, ", "), e.Msg)
+}
+
+// Is reports whether target is ErrConflict
+func (e *MergeConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// ServerError is an error reported by Irmin in a reply. Code is only set if the server returned a structured error.
+type ServerError struct {
+	Code    string
+	Message string
+	kind    error // sentinel error matched by errors.Is, if any
+}
+
+func (e *ServerError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("irmin error %s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("irmin error: %s", e.Message)
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.kind
+}
+
+// errorValue is the error field of a reply. Irmin returns errors either as a plain string or as an object with a code and a message.
+type errorValue struct {
+	Code    string
+	Message string
+}
+
+// String returns the error message
+func (e *errorValue) String() string {
+	return e.Message
+}
+
+// UnmarshalJSON unmarshals an error returned as a string (see Value) or as a { "code": ..., "message": ... } object
+func (e *errorValue) UnmarshalJSON(b []byte) error {
+	var obj struct {
+		Code    interface{} // may be a number or a string
+		Message *Value
+	}
+	if err := json.Unmarshal(b, &obj); err == nil && (obj.Code != nil || obj.Message != nil) {
+		if obj.Code != nil {
+			e.Code = fmt.Sprint(obj.Code)
+		}
+		if obj.Message != nil {
+			e.Message = obj.Message.String()
+		}
+		return nil
+	}
+	var v Value
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	e.Message = v.String()
+	return nil
+}
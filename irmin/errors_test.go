@@ -0,0 +1,47 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestErrorValueShapes(t *testing.T) {
+	for reply, want := range map[string]errorValue{
+		`"Unknown tag: dev"`:                       {Message: "Unknown tag: dev"},
+		`{"code":"conflict","message":"conflict"}`: {Code: "conflict", Message: "conflict"},
+		`{"code":409,"message":"conflict"}`:        {Code: "409", Message: "conflict"},
+		`{"code":409}`:                             {Code: "409"},
+		`{"message":"no code"}`:                    {Message: "no code"},
+		`{"message":{"hex":"6869"}}`:               {Message: "hi"},
+		`{"hex":"756e6b6e6f776e20746167"}`:         {Message: "unknown tag"},
+	} {
+		var e errorValue
+		if err := json.Unmarshal([]byte(reply), &e); err != nil {
+			t.Errorf("%s: %s", reply, err)
+			continue
+		}
+		if e != want {
+			t.Errorf("%s: got %+v, expected %+v", reply, e, want)
+		}
+	}
+	var e errorValue
+	if err := json.Unmarshal([]byte(`[1]`), &e); err == nil {
+		t.Errorf("got %+v for an invalid error, expected a decode error", e)
+	}
+}
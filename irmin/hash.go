@@ -0,0 +1,56 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// HashAlgorithm is the hash function a store uses to address contents
+type HashAlgorithm string
+
+const (
+	// HashGit is the Git blob hash, the SHA1 of "blob <size>\x00" followed by the contents. This is what Irmin's Git backend uses and the default.
+	HashGit HashAlgorithm = "git"
+	// HashSHA1 is the SHA1 of the contents, for stores that hash the raw value
+	HashSHA1 HashAlgorithm = "sha1"
+	// HashSHA256 is the SHA256 of the contents, for stores that hash the raw value
+	HashSHA256 HashAlgorithm = "sha256"
+)
+
+// SetHashAlgorithm sets the hash function HashContents and UpdateIfMatch use. It must match the store the server uses, which Irmin does not report over REST. The default is HashGit.
+func (rest *Conn) SetHashAlgorithm(alg HashAlgorithm) {
+	rest.hashAlgorithm = alg
+}
+
+// HashContents returns the hex-encoded hash the store assigns to a value, so hashes can be predicted before writing and contents deduplicated locally. The result is only meaningful if the hash algorithm set with SetHashAlgorithm matches the server's store.
+func (rest *Conn) HashContents(data []byte) (string, error) {
+	switch rest.hashAlgorithm {
+	case "", HashGit:
+		return contentHash(data), nil
+	case HashSHA1:
+		sum := sha1.Sum(data)
+		return hex.EncodeToString(sum[:]), nil
+	case HashSHA256:
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return "", fmt.Errorf("hash contents: unknown hash algorithm %q: %w", rest.hashAlgorithm, ErrUnsupported)
+}
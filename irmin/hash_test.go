@@ -0,0 +1,52 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHashContents(t *testing.T) {
+	for _, tc := range []struct {
+		alg  HashAlgorithm
+		data string
+		want string
+	}{
+		// Git blob hashes, as printed by git hash-object, which Irmin's Git backend stores values under
+		{"", "", "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"},
+		{HashGit, "hello\n", "ce013625030ba8dba906f756967f9e9ca394464a"},
+		{HashGit, `{"a":1}`, "daa5053ecf5f9a37b2de733d0751cc1ab53ac010"},
+		{HashSHA1, "", "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		{HashSHA1, "abc", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{HashSHA256, "", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{HashSHA256, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	} {
+		var c Conn
+		c.SetHashAlgorithm(tc.alg)
+		got, err := c.HashContents([]byte(tc.data))
+		if err != nil || got != tc.want {
+			t.Errorf("%q of %q: got %s, %v, expected %s", tc.alg, tc.data, got, err, tc.want)
+		}
+	}
+
+	var c Conn
+	c.SetHashAlgorithm("md5")
+	if _, err := c.HashContents(nil); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("got %v for an unknown algorithm, expected ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// HashedEntry is a key returned by ListHashed or IterHashed together with the hash of its contents. Hash is empty if the server did not report one.
+type HashedEntry struct {
+	Path Path   `json:"path"`
+	Hash string `json:"hash"`
+}
+
+// UnmarshalJSON decodes an entry from either a { "path": ..., "hash": ... } object or a plain path
+func (e *HashedEntry) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		type entry HashedEntry // without the UnmarshalJSON method
+		return json.Unmarshal(b, (*entry)(e))
+	}
+	e.Hash = ""
+	return json.Unmarshal(b, &e.Path)
+}
+
+type hashedListReply struct {
+	Result  []HashedEntry
+	Error   errorValue
+	Version Value
+}
+
+// hashParams asks the server to include hashes in a listing
+var hashParams = url.Values{"hashes": {"true"}}
+
+// ListHashed lists the keys in a path like List, and asks the server to include the hash of each entry, so changed entries can be found without reading every key. The standard Irmin REST server (0.9 and 0.10) ignores the request and returns plain keys, in which case Hash is empty for every entry.
+func (rest *Conn) ListHashed(path Path) ([]HashedEntry, error) {
+	var data hashedListReply
+	uri, err := rest.MakeCallURLWithParams("list", path, true, hashParams)
+	if err != nil {
+		return []HashedEntry{}, err
+	}
+	if err = rest.Call(uri, nil, &data); err != nil {
+		return []HashedEntry{}, err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		return []HashedEntry{}, err
+	}
+	if rest.sortResults {
+		sort.Slice(data.Result, func(i, j int) bool { return data.Result[i].Path.Compare(data.Result[j].Path) < 0 })
+	}
+	return data.Result, nil
+}
+
+// IterHashed iterates through all keys in the database like Iter, and asks the server to include the hash of each entry. See ListHashed for which servers provide hashes. The channel is closed early if an entry can't be decoded, and when ctx is done.
+func (rest *Conn) IterHashed(ctx context.Context) (<-chan HashedEntry, error) {
+	uri, err := rest.MakeCallURLWithParams("iter", Path{}, true, hashParams)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	ch, err := rest.callStream(ctx, uri, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if ch == nil {
+		cancel()
+		return nil, fmt.Errorf("%s: invalid stream from Irmin", uri.String())
+	}
+
+	out := make(chan HashedEntry, 1)
+
+	go func() {
+		defer func() {
+			cancel() // close the stream if we stop early
+			close(out)
+		}()
+		for m := range ch {
+			if m.err != nil {
+				rest.log.Printf("closing stream: %s\n", m.err)
+				return
+			}
+			var e HashedEntry
+			if err := json.Unmarshal(m.Result, &e); err != nil {
+				rest.log.Printf("%s: unable to decode entry: %s\n", uri.String(), err)
+				return
+			}
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
@@ -17,36 +17,48 @@
 package irmin
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
+	"net"
+	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
 
 type stringArrayReply struct {
 	Result  []Value
-	Error   Value
+	Error   errorValue
 	Version Value
 }
 
 type stringReply struct {
 	Result  Value
-	Error   Value
+	Error   errorValue
 	Version Value
 }
 
 type pathArrayReply struct {
 	Result  []Path
-	Error   Value
+	Error   errorValue
 	Version Value
 }
 
 type boolReply struct {
 	Result  bool
-	Error   Value
+	Error   errorValue
 	Version Value
 }
 
@@ -78,8 +90,9 @@ type WatchPathResult struct {
 }
 
 type postRequest struct {
-	Task Task            `json:"task"`
-	Data json.RawMessage `json:"params,omitempty"`
+	Task    Task            `json:"task"`
+	Data    json.RawMessage `json:"params,omitempty"`
+	Parents []string        `json:"parents,omitempty"` // explicit parents of the new commit
 }
 
 type commandsReply stringArrayReply
@@ -91,12 +104,57 @@ type updateReply stringReply
 type removeReply stringReply
 type removeRecReply stringReply
 type headReply stringArrayReply
+type commitReply stringReply
+type syncReply stringReply
+type abortReply stringReply
 
 // Conn is an Irmin REST API connection
 type Conn struct {
 	client
-	tree      string
-	taskowner string
+	tree        string
+	taskowner   string
+	sortResults bool
+	readOnly    bool
+	commands    *commandCache // shared by copies made with FromTree
+
+	maxValueBytes    int
+	truncateValues   bool
+	allowEmptyUpdate bool
+	taskUID          func() string
+	pathEncoder      PathEncoder
+	hashAlgorithm    HashAlgorithm
+}
+
+// PathEncoder encodes a path for use in a request URL. The result is appended to the command, so it must be empty for the root or start with a /, and the steps must be escaped as URL path segments.
+type PathEncoder func(path Path) string
+
+// commandCache caches the version and list of commands returned by Handshake
+type commandCache struct {
+	mu      sync.Mutex
+	version string
+	names   map[string]bool // nil if not fetched yet
+}
+
+// set replaces the cached version and commands. The caller must hold mu.
+func (c *commandCache) set(version string, cmds []string) {
+	c.version = version
+	c.names = make(map[string]bool, len(cmds))
+	for _, cmd := range cmds {
+		c.names[cmd] = true
+	}
+}
+
+// fetch fills the cache with a handshake unless it was already fetched. The caller must hold mu.
+func (c *commandCache) fetch(rest *Conn) error {
+	if c.names != nil {
+		return nil
+	}
+	version, cmds, err := rest.handshake()
+	if err != nil {
+		return err
+	}
+	c.set(version, cmds)
+	return nil
 }
 
 // Create an Irmin REST HTTP connection data structure
@@ -104,21 +162,189 @@ func Create(uri *url.URL, taskowner string) *Conn {
 	r := new(Conn)
 	r.client = *NewClient(uri, IgnoreLog{})
 	r.taskowner = taskowner
+	r.commands = new(commandCache)
+	return r
+}
+
+// CreateUnix creates an Irmin REST HTTP connection to a server listening on a Unix domain socket. Requests are built with http://unix/ URLs, but all connections, including streams, are dialed to socketPath.
+func CreateUnix(socketPath string, taskowner string) *Conn {
+	r := Create(&url.URL{Scheme: "http", Host: "unix"}, taskowner)
+	r.SetTransport(&http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	})
 	return r
 }
 
-// SetLog sets the log implementation. Log messages are ignored by default.
+// CreateFailover creates an Irmin REST HTTP connection that fails over between several servers. Requests are sent to the first server until it can't be reached, then to the next one in order. Only GET requests, which don't modify the store, are resent to another server after a connection error, unless idempotency keys are enabled (see SetIdempotencyKeys). Returns an error if uris is empty or contains nil.
+func CreateFailover(uris []*url.URL, taskowner string) (*Conn, error) {
+	if len(uris) == 0 {
+		return nil, fmt.Errorf("no servers to fail over between")
+	}
+	for i, u := range uris {
+		if u == nil {
+			return nil, fmt.Errorf("server %d has no URL", i)
+		}
+	}
+	r := Create(uris[0], taskowner)
+	r.servers = &serverList{uris: uris}
+	return r, nil
+}
+
+// BaseURI returns a copy of the URL the connection was created with, or nil if it was not initialized. For connections created with CreateFailover this is the first server; see ActiveServer for the one currently in use.
+func (rest *Conn) BaseURI() *url.URL {
+	if rest.baseURI == nil {
+		return nil
+	}
+	u := *rest.baseURI
+	return &u
+}
+
+// ActiveServer returns a copy of the URL of the server requests are currently sent to, or nil if the connection was not initialized
+func (rest *Conn) ActiveServer() *url.URL {
+	b := rest.base()
+	if b == nil {
+		return nil
+	}
+	u := *b
+	return &u
+}
+
+// SetLog sets the log implementation. Log messages are ignored by default. Each retry and failover is logged with the attempt number, the URL of the server that failed and the status or error that caused it.
 func (rest *Conn) SetLog(log Log) {
 	rest.log = log
 }
 
-// FromTree returns new Conn with a new tree position. An empty tree value defaults to master branch.
+// SetHTTPClient sets the http.Client used for all requests, including streams. http.DefaultClient is used by default.
+func (rest *Conn) SetHTTPClient(c *http.Client) {
+	rest.httpClient = c
+}
+
+// SetTransport sets the http.RoundTripper used for all requests, including streams. This can be used to wrap the transport for tracing or instrumentation.
+func (rest *Conn) SetTransport(rt http.RoundTripper) {
+	c := http.Client{}
+	if rest.httpClient != nil {
+		c = *rest.httpClient
+	}
+	c.Transport = rt
+	rest.httpClient = &c
+}
+
+// SetCompressRequests enables gzip compression of request bodies of at least threshold bytes. Compressed requests are sent with "Content-Encoding: gzip", which not all Irmin servers support, so compression is disabled by default (threshold 0).
+func (rest *Conn) SetCompressRequests(threshold int) {
+	rest.compressThreshold = threshold
+}
+
+// SetOnRequestBody sets a function that is called with the command name and the JSON body of every POST request before it is sent, e.g. to trace protocol problems. Note that bodies contain the values being written and may include sensitive data. Set to nil to disable.
+func (rest *Conn) SetOnRequestBody(f func(command string, body []byte)) {
+	rest.onRequestBody = f
+}
+
+// SetIdempotencyKeys enables sending a random Idempotency-Key header with every POST request. The key stays the same when a request is retried or failed over, which makes it safe to resend writes after an ambiguous failure, so writes are then retried like reads (see SetMaxRetries and CreateFailover). Irmin itself ignores the header: only enable this if the server, or a proxy in front of it, deduplicates requests with the same key.
+func (rest *Conn) SetIdempotencyKeys(enable bool) {
+	rest.idempotencyKeys = enable
+}
+
+// SetContentType sets the Content-Type header of POST requests, including those that start a stream, e.g. application/vnd.irmin+json for gateways that require a vendor type. Set to "" to use the default, application/json. The body is encoded as JSON regardless.
+func (rest *Conn) SetContentType(contentType string) {
+	rest.contentType = contentType
+}
+
+// SetReplyDecoder sets the decoder used for replies to command, e.g. "read", instead of encoding/json. The command is the first segment of the URL after the tree, so all commit/... commands share the decoder for "commit" and all view commands the one for "view". Streaming commands are not affected. Set dec to nil to restore the default. Like the other settings, the decoders are copied by FromTree, so later changes only affect the connection they are made on. Decoders must be set before the connection is used concurrently.
+func (rest *Conn) SetReplyDecoder(command string, dec ReplyDecoder) {
+	decoders := make(map[string]ReplyDecoder, len(rest.decoders)+1) // copy on write, as copies made with FromTree share the map
+	for c, d := range rest.decoders {
+		decoders[c] = d
+	}
+	if dec == nil {
+		delete(decoders, command)
+	} else {
+		decoders[command] = dec
+	}
+	rest.decoders = decoders
+}
+
+// SetEnvelopeEncoder sets the function used to encode the body of POST requests, e.g. for servers that expect different field names. Set to nil to use the default { "task": ..., "params": ..., "parents": ... } envelope, where "parents" is only present for commits with explicit parents.
+func (rest *Conn) SetEnvelopeEncoder(enc EnvelopeEncoder) {
+	rest.envelope = enc
+}
+
+// SetMaxRetries sets how many times a read-only (GET) request, or any request if idempotency keys are enabled, is retried when Irmin replies 503 Service Unavailable. The Retry-After header is honored if present. Requests are not retried by default.
+func (rest *Conn) SetMaxRetries(n int) {
+	rest.maxRetries = n
+}
+
+// SetMaxResponseBytes limits the size of replies to non-streaming commands. Larger replies are rejected with an error. The default is 0 (unlimited), which lets a misbehaving server make the client buffer an arbitrarily large reply in memory.
+func (rest *Conn) SetMaxResponseBytes(n int64) {
+	rest.maxResponseBytes = n
+}
+
+// SetPathEncoder sets the function MakeCallURL uses to encode paths, for HTTP frontends that expect a different separator or escaping. Set to nil to use the default, which separates the steps with / and escapes each step.
+func (rest *Conn) SetPathEncoder(enc PathEncoder) {
+	rest.pathEncoder = enc
+}
+
+// SetAllowEmptyUpdate controls what Update does when Irmin returns no hash, which some servers do when the value is unchanged. By default this is an error. If allow is true the update is treated as a no-op and the empty hash "" is returned with no error, as no commit was made. The head is not returned instead, since reading it after the write may return another writer's commit.
+func (rest *Conn) SetAllowEmptyUpdate(allow bool) {
+	rest.allowEmptyUpdate = allow
+}
+
+// SetMaxValueBytes limits the size of values returned by Read and the functions built on it. If truncate is true, larger values are cut to n bytes, otherwise they are rejected with an error wrapping ErrLimitExceeded. The default is 0 (unlimited). The limit is checked after the reply has been decoded, so also use SetMaxResponseBytes to bound the memory used by a read.
+func (rest *Conn) SetMaxValueBytes(n int, truncate bool) {
+	rest.maxValueBytes = n
+	rest.truncateValues = truncate
+}
+
+// limitValue applies the limit set by SetMaxValueBytes to the value read from path
+func (rest *Conn) limitValue(path Path, v []byte) ([]byte, error) {
+	if rest.maxValueBytes <= 0 || len(v) <= rest.maxValueBytes {
+		return v, nil
+	}
+	if rest.truncateValues {
+		return v[:rest.maxValueBytes], nil
+	}
+	return nil, fmt.Errorf("value of %s is larger than %d bytes: %w", path.String(), rest.maxValueBytes, ErrLimitExceeded)
+}
+
+// SetSortResults enables sorting of the keys returned by List. Irmin does not guarantee any particular order, so by default keys are returned in the order they are received. When enabled keys are sorted step by step in lexicographic byte order.
+func (rest *Conn) SetSortResults(sort bool) {
+	rest.sortResults = sort
+}
+
+// SetReadOnly makes all commands that modify the store return ErrReadOnly without contacting Irmin. Reads, iteration and watches are not affected.
+func (rest *Conn) SetReadOnly(readOnly bool) {
+	rest.readOnly = readOnly
+}
+
+// ReadOnly returns true if commands that modify the store are disabled
+func (rest *Conn) ReadOnly() bool {
+	return rest.readOnly
+}
+
+// checkWritable returns ErrReadOnly if the connection is read-only
+func (rest *Conn) checkWritable() error {
+	if rest.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// FromTree returns new Conn with a new tree position. The tree is the name of a branch (tag) or a commit hash, and commands that support it are sent to /tree/<tree>/<command>. An empty tree value defaults to master branch.
 func (rest *Conn) FromTree(tree string) *Conn {
 	t := *rest
 	t.tree = tree
 	return &t
 }
 
+// AtCommit returns a new read-only Conn where all reads are made at the commit with the given hash. Every read sees the same snapshot, even if branches are updated concurrently. Commands that modify the store return ErrReadOnly.
+func (rest *Conn) AtCommit(hash string) *Conn {
+	t := rest.FromTree(hash)
+	t.readOnly = true
+	return t
+}
+
 // Tree reads the current tree position use for Tree sub-commands. Empty defaults to master.
 func (rest *Conn) Tree() string {
 	return rest.tree
@@ -134,28 +360,74 @@ func (rest *Conn) SetTaskOwner(owner string) {
 	rest.taskowner = owner
 }
 
-// NewTask creates a new task (commit message) that can be be submitted with a command
+// taskUID is the last uid returned by nextTaskUID. It starts at a random value so uids from different processes are unlikely to collide.
+var taskUID = func() int64 {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand should never fail
+	}
+	return int64(binary.BigEndian.Uint32(b)) << 16
+}()
+
+// nextTaskUID returns a new task uid. Irmin stores uids as 64 bit integers, so they are decimal numbers.
+func nextTaskUID() string {
+	return strconv.FormatInt(atomic.AddInt64(&taskUID, 1), 10)
+}
+
+// NewTask creates a new task (commit message) that can be be submitted with a command. Each task gets a new uid.
 func NewTask(taskowner string, message string) Task {
 	var t Task
 	t.Date = fmt.Sprintf("%d", time.Now().Unix())
-	t.UID = "0"
+	t.UID = nextTaskUID()
 	t.Owner = NewValue(taskowner)
 	t.Messages = []Value{NewValue(message)}
 	return t
 }
 
-// NewTask creates a new task that can be be submitted with a command (commit message)
+// TaskFrom creates a task with all fields set explicitly, e.g. to preserve commit metadata imported from another system
+func TaskFrom(owner string, date time.Time, messages []string, uid string) Task {
+	var t Task
+	t.Date = fmt.Sprintf("%d", date.Unix())
+	t.UID = uid
+	t.Owner = NewValue(owner)
+	t.Messages = make([]Value, len(messages))
+	for i, m := range messages {
+		t.Messages[i] = NewValue(m)
+	}
+	return t
+}
+
+// NewTask creates a new task that can be be submitted with a command (commit message). The uid is set by the generator set with SetTaskUIDGenerator.
 func (rest *Conn) NewTask(message string) Task {
-	return NewTask(rest.taskowner, message)
+	t := NewTask(rest.taskowner, message)
+	if rest.taskUID != nil {
+		t.UID = rest.taskUID()
+	}
+	return t
 }
 
-// MakeCallURL creates an invocation URL for an Irmin REST command with an optional sub command type
+// SetTaskUIDGenerator sets the function that returns the uid of tasks created with NewTask, e.g. a counter starting at 0 for reproducible tests. The default (nil) generates unique increasing decimal uids. Irmin parses uids as 64 bit integers, so the function should return decimal numbers.
+func (rest *Conn) SetTaskUIDGenerator(f func() string) {
+	rest.taskUID = f
+}
+
+// MakeCallURL creates an invocation URL for an Irmin REST command with an optional sub command type.
+// If supportsTree is set and a tree is selected (see FromTree) the URL is /tree/<tree>/<command>/<path>, otherwise /<command>/<path>.
+// The empty path is the root and adds nothing, e.g. /list lists the root and /iter iterates over the whole tree. Irmin treats a trailing / as an extra empty step, so the root must not be passed as a path with one empty step.
 func (rest *Conn) MakeCallURL(command string, path Path, supportsTree bool) (*url.URL, error) {
 	var suffix *url.URL
 	var err error
 
-	u := path.URL()
-	p := strings.Replace(u.String(), "+", "%20", -1) // Replace + with %20, see https://github.com/golang/go/issues/4013
+	if err = rest.initialized(); err != nil {
+		return nil, err
+	}
+	var p string
+	if rest.pathEncoder != nil {
+		p = rest.pathEncoder(path)
+	} else {
+		u := path.URL()
+		p = strings.Replace(u.String(), "+", "%20", -1) // Replace + with %20, see https://github.com/golang/go/issues/4013
+	}
 
 	if supportsTree && rest.Tree() != "" { // Ignore the parameter if Tree is not set
 		t := url.QueryEscape(rest.Tree())
@@ -168,51 +440,171 @@ func (rest *Conn) MakeCallURL(command string, path Path, supportsTree bool) (*ur
 		}
 	}
 
-	return rest.baseURI.ResolveReference(suffix), nil
+	return rest.base().ResolveReference(suffix), nil
+}
+
+// MakeCallURLWithParams creates an invocation URL like MakeCallURL and appends params as the query string. Empty params are ignored.
+func (rest *Conn) MakeCallURLWithParams(command string, path Path, supportsTree bool, params url.Values) (*url.URL, error) {
+	u, err := rest.MakeCallURL(command, path, supportsTree)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) > 0 {
+		u.RawQuery = params.Encode()
+	}
+	return u, nil
+}
+
+// replyError converts an error returned by Irmin to an error. Returns nil if there was no error. Errors are returned as *ServerError, except for unknown trees which return *UnknownRefError.
+func (rest *Conn) replyError(e errorValue) error {
+	if e.Message == "" && e.Code == "" {
+		return nil
+	}
+	serr := &ServerError{Code: e.Code, Message: e.Message}
+	lmsg := strings.ToLower(e.Message)
+	if strings.Contains(lmsg, "conflict") {
+		serr.kind = ErrConflict
+		return serr
+	}
+	if strings.Contains(lmsg, "duplicated") || strings.Contains(lmsg, "already exists") {
+		serr.kind = ErrRefExists
+		return serr
+	}
+	for _, s := range []string{"unknown tag", "unknown branch", "unknown tree", "unknown ref", "invalid tag", "no head"} {
+		if strings.Contains(lmsg, s) {
+			return rest.unknownRef(e.Message)
+		}
+	}
+	return serr
+}
+
+// treeName returns the name of the current tree, or master if it is not set
+func (rest *Conn) treeName() string {
+	if rest.Tree() == "" {
+		return "master"
+	}
+	return rest.Tree()
+}
+
+// unknownRef returns an *UnknownRefError for the current tree
+func (rest *Conn) unknownRef(msg string) error {
+	return &UnknownRefError{Ref: rest.treeName(), Msg: msg}
 }
 
 // AvailableCommands queries Irmin for a list of available commands
 func (rest *Conn) AvailableCommands() ([]string, error) {
-	var data commandsReply
+	_, cmds, err := rest.handshake()
+	return cmds, err
+}
+
+// Handshake checks that the server can be reached and returns its version and list of available commands with a single request, which is cheaper than calling Version and AvailableCommands separately. The result is cached and used by SupportsCommand and ServerVersion.
+func (rest *Conn) Handshake() (version string, commands []string, err error) {
+	version, commands, err = rest.handshake()
+	if err != nil || rest.commands == nil {
+		return
+	}
+	rest.commands.mu.Lock()
+	rest.commands.set(version, commands)
+	rest.commands.mu.Unlock()
+	return
+}
 
+// handshake is like Handshake, but does not update the cache. It is also used by Version and AvailableCommands, which always ask the server.
+func (rest *Conn) handshake() (string, []string, error) {
+	var data commandsReply
 	uri, err := rest.MakeCallURL("", Path{}, true)
 	if err != nil {
-		return []string{}, err
+		return "", []string{}, err
 	}
-
 	if err = rest.Call(uri, nil, &data); err != nil {
-		return []string{}, err
+		return "", []string{}, err
 	}
-	if data.Error.String() != "" {
-		return []string{}, fmt.Errorf(data.Error.String())
+	if err = rest.replyError(data.Error); err != nil {
+		return "", []string{}, err
 	}
-
 	r := make([]string, len(data.Result))
 	for i, v := range data.Result {
 		r[i] = v.String()
 	}
-	return r, nil
+	return data.Version.String(), r, nil
+}
+
+// SupportsCommand returns true if Irmin lists name as an available command. The command list is fetched once with Handshake and cached, so clients can check for optional commands cheaply. Call InvalidateCommands to fetch it again, e.g. after the server was upgraded.
+func (rest *Conn) SupportsCommand(name string) (bool, error) {
+	if rest.commands == nil { // not created with Create, so there is no cache
+		return rest.hasCommand(name)
+	}
+	rest.commands.mu.Lock()
+	defer rest.commands.mu.Unlock()
+	if err := rest.commands.fetch(rest); err != nil {
+		return false, err
+	}
+	return rest.commands.names[name], nil
+}
+
+// ServerVersion returns the Irmin version like Version, but uses the version cached by Handshake or SupportsCommand, and only asks the server if there is none.
+func (rest *Conn) ServerVersion() (string, error) {
+	if rest.commands == nil { // not created with Create, so there is no cache
+		return rest.Version()
+	}
+	rest.commands.mu.Lock()
+	defer rest.commands.mu.Unlock()
+	if err := rest.commands.fetch(rest); err != nil {
+		return "", err
+	}
+	return rest.commands.version, nil
+}
+
+// InvalidateCommands clears the version and command list cached by Handshake, SupportsCommand and ServerVersion
+func (rest *Conn) InvalidateCommands() {
+	if rest.commands == nil {
+		return
+	}
+	rest.commands.mu.Lock()
+	rest.commands.version = ""
+	rest.commands.names = nil
+	rest.commands.mu.Unlock()
+}
+
+// hasCommand returns true if Irmin lists name as an available command
+func (rest *Conn) hasCommand(name string) (bool, error) {
+	cmds, err := rest.AvailableCommands()
+	if err != nil {
+		return false, err
+	}
+	for _, c := range cmds {
+		if c == name {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 // Version returns the Irmin version
 func (rest *Conn) Version() (string, error) {
+	version, _, err := rest.handshake()
+	return version, err
+}
+
+// ServerTime returns the time reported by the server in the Date header of its reply. Irmin has no clock command, so the precision is one second. The result can be compared with time.Now to estimate clock skew before creating tasks with NewTask or TaskFrom, whose dates are set by the client.
+func (rest *Conn) ServerTime() (time.Time, error) {
 	var data commandsReply
-	var err error
 	uri, err := rest.MakeCallURL("", Path{}, true)
 	if err != nil {
-		return "", err
+		return time.Time{}, err
 	}
-	if err = rest.Call(uri, nil, &data); err != nil {
-		return "", err
+	res, err := rest.call(uri, nil, &data)
+	if err != nil {
+		return time.Time{}, err
 	}
-	if data.Error.String() != "" {
-		return "", fmt.Errorf(data.Error.String())
+	date := res.Header.Get("Date")
+	if date == "" {
+		return time.Time{}, fmt.Errorf("server did not send a Date header")
 	}
-
-	return data.Version.String(), nil
+	return http.ParseTime(date)
 }
 
-// List returns a list of keys in a path
+// List returns a list of keys in a path. The keys are in the order returned by Irmin unless sorting is enabled with SetSortResults.
 func (rest *Conn) List(path Path) ([]Path, error) {
 	var data listReply
 	uri, err := rest.MakeCallURL("list", path, true)
@@ -222,8 +614,11 @@ func (rest *Conn) List(path Path) ([]Path, error) {
 	if err = rest.Call(uri, nil, &data); err != nil {
 		return []Path{}, err
 	}
-	if data.Error.String() != "" {
-		return []Path{}, fmt.Errorf(data.Error.String())
+	if err = rest.replyError(data.Error); err != nil {
+		return []Path{}, err
+	}
+	if rest.sortResults {
+		SortPaths(data.Result)
 	}
 
 	return data.Result, nil
@@ -239,13 +634,13 @@ func (rest *Conn) Mem(path Path) (bool, error) {
 	if err = rest.Call(uri, nil, &data); err != nil {
 		return false, err
 	}
-	if data.Error.String() != "" {
-		return false, fmt.Errorf(data.Error.String())
+	if err = rest.replyError(data.Error); err != nil {
+		return false, err
 	}
 	return data.Result, nil
 }
 
-// Head returns the commit hash of HEAD
+// Head returns the commit hash of HEAD. Returns ErrUnknownRef if the current tree has no head commit.
 func (rest *Conn) Head() ([]byte, error) {
 	var data headReply
 	uri, err := rest.MakeCallURL("head", nil, true)
@@ -255,8 +650,8 @@ func (rest *Conn) Head() ([]byte, error) {
 	if err = rest.Call(uri, nil, &data); err != nil {
 		return []byte{}, err
 	}
-	if data.Error.String() != "" {
-		return []byte{}, fmt.Errorf("irmin error: %s", data.Error.String())
+	if err = rest.replyError(data.Error); err != nil {
+		return []byte{}, err
 	}
 	if len(data.Result) > 1 {
 		return []byte{}, fmt.Errorf("head returned more than one result")
@@ -268,29 +663,212 @@ func (rest *Conn) Head() ([]byte, error) {
 		}
 		return hash, nil
 	}
-	return []byte{}, fmt.Errorf("Invalid data from Irmin.")
+	return []byte{}, rest.unknownRef("no head commit") // a tag always points to a commit
+}
+
+// Resolve returns the hash of the commit a tag (branch) points to. Returns ErrUnknownRef if the tag does not exist.
+func (rest *Conn) Resolve(ref string) (string, error) {
+	if ref == "" {
+		return "", fmt.Errorf("resolve: empty ref")
+	}
+	head, err := rest.FromTree(ref).Head()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(head), nil
 }
 
 // Read key value as byte array
 func (rest *Conn) Read(path Path) ([]byte, error) {
-	var data readReply
+	res, _, err := rest.read(path)
+	return res, err
+}
+
+// ReadResponse reads a key value like Read and also returns the HTTP response, e.g. to inspect headers added by the server or a proxy. The response body has already been read and closed. The response is nil if the request failed before a reply was received.
+func (rest *Conn) ReadResponse(path Path) ([]byte, *http.Response, error) {
+	return rest.read(path)
+}
+
+// read reads a key value and returns it with the HTTP response
+func (rest *Conn) read(path Path) ([]byte, *http.Response, error) {
 	uri, err := rest.MakeCallURL("read", path, true)
 	if err != nil {
-		return []byte{}, err
+		return []byte{}, nil, err
 	}
-	if err = rest.Call(uri, nil, &data); err != nil {
-		return []byte{}, err
+	res, body, err := rest.callRaw(uri, nil)
+	if err != nil {
+		return []byte{}, res, err
+	}
+	v, err := rest.decodeReadValue(uri, res, body, path)
+	return v, res, err
+}
+
+// decodeReadReply decodes the reply to a read command and returns all values in it. Returns ErrNotFound if there are none.
+func (rest *Conn) decodeReadReply(uri *url.URL, res *http.Response, body []byte, path Path) ([][]byte, error) {
+	var data readReply
+	if err := rest.decodeReply(uri, res, body, &data); err != nil {
+		return nil, err
+	}
+	if err := rest.replyError(data.Error); err != nil {
+		return nil, err
 	}
-	if data.Error.String() != "" {
-		return []byte{}, fmt.Errorf(data.Error.String())
+	if len(data.Result) == 0 {
+		return nil, fmt.Errorf("invalid key %s: %w", path.String(), ErrNotFound)
 	}
-	if len(data.Result) > 1 {
+	r := make([][]byte, len(data.Result))
+	for i, v := range data.Result {
+		var err error
+		if r[i], err = rest.limitValue(path, v); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// decodeReadValue decodes the reply to a read command like decodeReadReply, but fails if there is more than one value
+func (rest *Conn) decodeReadValue(uri *url.URL, res *http.Response, body []byte, path Path) ([]byte, error) {
+	values, err := rest.decodeReadReply(uri, res, body, path)
+	if err != nil {
+		return []byte{}, err
+	}
+	if len(values) > 1 {
 		return []byte{}, fmt.Errorf("read %s returned more than one result", path.String())
 	}
-	if len(data.Result) == 1 {
-		return data.Result[0], nil
+	return values[0], nil
+}
+
+// ReadRaw reads a key and returns the value without assuming it is a string, together with the content type declared by the server. The standard Irmin server wraps values in a JSON reply (Content-Type application/json, or no Content-Type); the value is then decoded from the reply like Read, including with a decoder set with SetReplyDecoder, and the content type is that of the reply. Servers that store values in another serialization, e.g. OCaml's Marshal format, may instead return the value itself as the body with its own Content-Type, and the body is then returned unchanged.
+func (rest *Conn) ReadRaw(path Path) ([]byte, string, error) {
+	uri, err := rest.MakeCallURL("read", path, true)
+	if err != nil {
+		return nil, "", err
+	}
+	res, body, err := rest.callRaw(uri, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := res.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if contentType != "" && mediaType != "application/json" {
+		if res.StatusCode >= 300 {
+			return nil, contentType, statusError(uri, res)
+		}
+		return body, contentType, nil
+	}
+	v, err := rest.decodeReadValue(uri, res, body, path)
+	if err != nil {
+		return nil, contentType, err
+	}
+	return v, contentType, nil
+}
+
+// ReadOrDefault reads a key value as byte array. If the key does not exist def is returned instead.
+func (rest *Conn) ReadOrDefault(path Path, def []byte) ([]byte, error) {
+	res, err := rest.Read(path)
+	if errors.Is(err, ErrNotFound) {
+		return def, nil
+	}
+	return res, err
+}
+
+// ReadVersioned reads a key like Read and also returns the hash of the commit the value was read from. The value is read from that commit rather than the tree, so it is consistent with the returned version even if the tree moves meanwhile. The version changes whenever the tree has a new commit, even if this key was not changed, so it can be used to validate caches, but not to detect changes to a single key.
+func (rest *Conn) ReadVersioned(path Path) (data []byte, version string, err error) {
+	head, err := rest.Head()
+	if err != nil {
+		return nil, "", err
+	}
+	version = hex.EncodeToString(head)
+	data, err = rest.AtCommit(version).Read(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, version, nil
+}
+
+// ReadSnapshot reads several keys from the same commit, so the values are consistent with each other even if the tree moves while they are read. Returns the values indexed by the escaped URL form of each path, p.URL().String(), which unlike String keeps steps containing / apart, and the hash of the commit they were read from. Keys that don't exist are left out of the map.
+func (rest *Conn) ReadSnapshot(paths []Path) (map[string][]byte, string, error) {
+	head, err := rest.Head()
+	if err != nil {
+		return nil, "", err
+	}
+	commit := hex.EncodeToString(head)
+	at := rest.AtCommit(commit)
+
+	r := make(map[string][]byte, len(paths))
+	for _, p := range paths {
+		v, found, err := at.TryRead(p)
+		if err != nil {
+			return nil, "", err
+		}
+		if found {
+			r[p.URL().String()] = v
+		}
+	}
+	return r, commit, nil
+}
+
+// ReadAllResults reads a key like Read, but returns every value in the reply instead of failing when there is more than one. Irmin encodes the value of a key as a list that is empty if the key does not exist, so the standard server returns at most one value. Servers or proxies that store several values per key (e.g. unresolved concurrent writes) may return more. Returns ErrNotFound if there are none.
+func (rest *Conn) ReadAllResults(path Path) ([][]byte, error) {
+	uri, err := rest.MakeCallURL("read", path, true)
+	if err != nil {
+		return nil, err
+	}
+	res, body, err := rest.callRaw(uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	return rest.decodeReadReply(uri, res, body, path)
+}
+
+// TryRead reads the value of a key. found is false if the key does not exist, in which case err is nil. err is only set for other failures, e.g. transport or server errors.
+func (rest *Conn) TryRead(path Path) (value []byte, found bool, err error) {
+	value, err = rest.Read(path)
+	if errors.Is(err, ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// HasChanged returns true if candidate differs from the value stored in a key, or if the key does not exist. This can be used to skip updates that would not change anything. The stored value is read in full, as Irmin does not report content hashes.
+func (rest *Conn) HasChanged(path Path, candidate []byte) (bool, error) {
+	res, err := rest.Read(path)
+	if errors.Is(err, ErrNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
 	}
-	return []byte{}, fmt.Errorf("invalid key %s", path.String())
+	return !bytes.Equal(res, candidate), nil
+}
+
+// Node reads the value of a key and lists its children. The two requests are sent concurrently. A key without a value returns a nil value and a key without children returns an empty list. ErrNotFound is returned if the key has neither.
+func (rest *Conn) Node(path Path) ([]byte, []Path, error) {
+	var value []byte
+	var readErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		value, readErr = rest.Read(path)
+	}()
+
+	children, err := rest.List(path)
+	<-done
+	if err != nil {
+		return nil, []Path{}, err
+	}
+	if errors.Is(readErr, ErrNotFound) {
+		if len(children) == 0 {
+			return nil, []Path{}, readErr
+		}
+		return nil, children, nil
+	}
+	if readErr != nil {
+		return nil, []Path{}, readErr
+	}
+	return value, children, nil
 }
 
 // ReadString reads a value as string. The value must contain a valid UTF-8 encoded string.
@@ -305,8 +883,74 @@ func (rest *Conn) ReadString(path Path) (string, error) {
 	return "", fmt.Errorf("path %s does not contain a valid utf8 string", path.String())
 }
 
-// Update a key. Returns hash as string on success.
+// ReadInt reads a value containing a decimal integer, as written with ValueFromInt. Surrounding whitespace is ignored.
+func (rest *Conn) ReadInt(path Path) (int64, error) {
+	res, err := rest.Read(path)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.ParseInt(strings.TrimSpace(string(res)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("path %s does not contain a valid integer: %q", path.String(), res)
+	}
+	return i, nil
+}
+
+// ReadBool reads a value containing "true" or "false", as written with ValueFromBool. The other forms accepted by strconv.ParseBool (1, t, F etc.) are also accepted and surrounding whitespace is ignored.
+func (rest *Conn) ReadBool(path Path) (bool, error) {
+	res, err := rest.Read(path)
+	if err != nil {
+		return false, err
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(string(res)))
+	if err != nil {
+		return false, fmt.Errorf("path %s does not contain a valid bool: %q", path.String(), res)
+	}
+	return b, nil
+}
+
+// Update a key. Returns hash as string on success. Irmin creates missing parent nodes automatically, so a/b/c can be written even if a does not exist.
 func (rest *Conn) Update(t Task, path Path, contents []byte) (string, error) {
+	return rest.update(t, path, contents, nil)
+}
+
+// UpdateDeep updates a key like Update, but reports clearly if the server refused to create the parents of the key. Irmin itself creates missing parent nodes, and a node can have both a value and children, so this only fails on servers with a stricter store model. The path must not be empty or contain empty steps. A server error is only reported as a parent error if its code or message mentions parents or a node that is not a directory; other errors, such as conflicts, are returned unchanged.
+func (rest *Conn) UpdateDeep(t Task, path Path, contents []byte) (string, error) {
+	if len(path) == 0 {
+		return "", fmt.Errorf("update: can't write a value to the root")
+	}
+	for i, step := range path {
+		if len(step) == 0 {
+			return "", fmt.Errorf("update %s: step %d is empty", path.String(), i)
+		}
+	}
+	hash, err := rest.update(t, path, contents, nil)
+	var serr *ServerError
+	if errors.As(err, &serr) && len(path) > 1 && isParentError(serr) {
+		return "", fmt.Errorf("update %s: server rejected creating the parents of the key: %w", path.String(), err)
+	}
+	return hash, err
+}
+
+// isParentError returns true if a server error is about the parents of a key
+func isParentError(e *ServerError) bool {
+	s := strings.ToLower(e.Code + " " + e.Message)
+	return strings.Contains(s, "parent") || strings.Contains(s, "not a directory")
+}
+
+// UpdateWithParents updates a key like Update, but the new commit gets the given parent commits instead of the current head. The server must support explicit parents.
+func (rest *Conn) UpdateWithParents(t Task, path Path, contents []byte, parents []string) (string, error) {
+	if err := validateParents(parents); err != nil {
+		return "", err
+	}
+	return rest.update(t, path, contents, parents)
+}
+
+// update updates a key, optionally with explicit parents
+func (rest *Conn) update(t Task, path Path, contents []byte, parents []string) (string, error) {
+	if err := rest.checkWritable(); err != nil {
+		return "", err
+	}
 	var data updateReply
 	var err error
 
@@ -319,6 +963,7 @@ func (rest *Conn) Update(t Task, path Path, contents []byte) (string, error) {
 	}
 
 	body.Task = t
+	body.Parents = parents
 
 	uri, err := rest.MakeCallURL("update", path, true)
 	if err != nil {
@@ -327,29 +972,35 @@ func (rest *Conn) Update(t Task, path Path, contents []byte) (string, error) {
 	if err = rest.Call(uri, &body, &data); err != nil {
 		return data.Result.String(), err
 	}
-	if data.Error.String() != "" {
-		return "", fmt.Errorf(data.Error.String())
+	if err = rest.replyError(data.Error); err != nil {
+		return "", err
 	}
 	if data.Result.String() == "" {
-		return "", fmt.Errorf("update seemed to succeed, but didn't return a hash", path.String(), data.Result.String())
+		if rest.allowEmptyUpdate { // no commit was made
+			return "", nil
+		}
+		return "", fmt.Errorf("update %s seemed to succeed, but didn't return a hash", path.String())
 	}
 
 	return data.Result.String(), nil
 }
 
-// Remove key
+// Remove removes the value stored at path. Keys below it are left in place, so this also clears the value of a node that has children; use RemoveRec to remove the subtree.
 func (rest *Conn) Remove(t Task, path Path) error {
+	if err := rest.checkWritable(); err != nil {
+		return err
+	}
 	var data removeReply
 	uri, err := rest.MakeCallURL("remove", path, true)
 	if err != nil {
 		return err
 	}
-	body := postRequest{t, nil}
+	body := postRequest{Task: t}
 	if err = rest.Call(uri, &body, &data); err != nil {
 		return err
 	}
-	if data.Error.String() != "" {
-		return fmt.Errorf(data.Error.String())
+	if err = rest.replyError(data.Error); err != nil {
+		return err
 	}
 	if len(data.Result) > 1 {
 		return fmt.Errorf("remove %s returned more than one result", path.String())
@@ -360,82 +1011,271 @@ func (rest *Conn) Remove(t Task, path Path) error {
 
 // RemoveRec removes a key and its subtree recursively
 func (rest *Conn) RemoveRec(t Task, path Path) error {
+	if err := rest.checkWritable(); err != nil {
+		return err
+	}
 	var data removeReply
 	uri, err := rest.MakeCallURL("remove-rec", path, true)
 	if err != nil {
 		return err
 	}
-	body := postRequest{t, nil}
+	body := postRequest{Task: t}
 	if err = rest.Call(uri, &body, &data); err != nil {
 		return err
 	}
-	if data.Error.String() != "" {
-		return fmt.Errorf(data.Error.String())
-		return fmt.Errorf("remove-rec %s returned empty result", path.String())
+	if err = rest.replyError(data.Error); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-// Iter iterates through all keys in database. Returns results in a channel as they are received.
+// Iter iterates through all keys in database. Returns results in a channel as they are received, in no particular order. The stream is decoded one key at a time, so memory use does not grow with the number of keys. The channel is closed early if a key can't be decoded.
 func (rest *Conn) Iter() (<-chan *Path, error) {
+	return rest.iter(context.Background())
+}
+
+// ListAll returns all keys in the database. If max is not 0 at most max keys are returned, together with ErrLimitExceeded if there were more. Callers that accept a truncated result can ignore ErrLimitExceeded. If the stream fails, the keys read so far are returned with the error.
+func (rest *Conn) ListAll(max int) ([]Path, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // stop the stream if we return early
+
+	ch, err := rest.IterResults(ctx)
+	if err != nil {
+		return []Path{}, err
+	}
+	r := []Path{}
+	for p := range ch {
+		if p.Err != nil {
+			return r, p.Err
+		}
+		if max > 0 && len(r) == max {
+			return r, fmt.Errorf("more than %d keys: %w", max, ErrLimitExceeded)
+		}
+		r = append(r, p.Path)
+	}
+	return r, nil
+}
+
+// iter is like Iter, but the stream is closed when ctx is done
+func (rest *Conn) iter(ctx context.Context) (<-chan *Path, error) {
 	uri, err := rest.MakeCallURL("iter", Path{}, true)
 	if err != nil {
 		return nil, err
 	}
-	var ch <-chan *streamReply
-	if ch, err = rest.CallStream(uri, nil); err != nil || ch == nil {
+	return rest.iterPaths(ctx, uri)
+}
+
+// PathResult is a key returned by IterResults, or the error that ended the iteration
+type PathResult struct {
+	Path Path
+	Err  error
+}
+
+// IterResults iterates through all keys in database like Iter, but fails fast: if the stream can't be read or decoded, the error is sent as the last result and the channel is closed. The stream is also closed when ctx is done.
+func (rest *Conn) IterResults(ctx context.Context) (<-chan PathResult, error) {
+	uri, err := rest.MakeCallURL("iter", Path{}, true)
+	if err != nil {
 		return nil, err
 	}
+	return rest.iterResults(ctx, uri)
+}
 
-	out := make(chan *Path, 1)
+// iterResults calls an iter command and decodes the paths in the stream. The channel is closed after the first error.
+func (rest *Conn) iterResults(ctx context.Context, uri *url.URL) (<-chan PathResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch, err := rest.callStream(ctx, uri, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if ch == nil {
+		cancel()
+		return nil, fmt.Errorf("%s: invalid stream from Irmin", uri.String())
+	}
+
+	out := make(chan PathResult, 1)
 
 	go func() {
-		defer close(out)
+		defer func() {
+			cancel() // close the stream if we stop early
+			close(out)
+		}()
 		for m := range ch {
-			p := new(Path)
-			if err := json.Unmarshal(m.Result, &p); err != nil {
-				panic(err) // TODO This should be returned to caller
+			var r PathResult
+			if m.err != nil {
+				r.Err = m.err
+			} else if err := json.Unmarshal(m.Result, &r.Path); err != nil {
+				r.Err = fmt.Errorf("%s: unable to decode path: %w", uri.String(), err)
+			}
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				return
+			}
+			if r.Err != nil {
+				return
 			}
-			out <- p
 		}
 	}()
 
-	return out, err
+	return out, nil
+}
+
+// iterPaths calls an iter command and decodes the paths in the stream. Errors are logged and close the channel.
+func (rest *Conn) iterPaths(ctx context.Context, uri *url.URL) (<-chan *Path, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch, err := rest.iterResults(ctx, uri)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan *Path, 1)
+
+	go func() {
+		defer func() {
+			cancel()
+			close(out)
+		}()
+		for r := range ch {
+			if r.Err != nil {
+				rest.log.Printf("closing stream: %s\n", r.Err)
+				return
+			}
+			p := r.Path
+			select {
+			case out <- &p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// Count returns the number of keys with a value under path, including path itself. The whole tree is counted while iterating, without storing the keys; a subtree is listed level by level from the current head, so the work does not depend on the size of the rest of the store. If the keys can't be read, the error is returned instead of a partial count.
+func (rest *Conn) Count(path Path) (int, error) {
+	if len(path) == 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel() // stop the stream if we return early
+		ch, err := rest.IterResults(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for r := range ch {
+			if r.Err != nil {
+				return 0, r.Err
+			}
+			n++
+		}
+		return n, nil
+	}
+
+	head, err := rest.Head()
+	if err != nil {
+		return 0, err
+	}
+	at := rest.AtCommit(hex.EncodeToString(head)) // count the keys in one commit
+	keys, err := at.listRecursive(path, -1)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range append([]Path{path}, keys...) {
+		exists, err := at.Mem(k) // nodes that only have children have no value
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			n++
+		}
+	}
+	return n, nil
 }
 
 // Watch a specific key for create/delete/update. Returns commit/value pairs. This function is not recursive (see WatchPath)
 func (rest *Conn) Watch(path Path) (<-chan *CommitValuePair, error) { // TODO not path
-	type watchKeyReply [][]Value // An array of arrays of commit/value pairs
+	return rest.watch(context.Background(), path)
+}
+
+// WatchOnce waits for the next create/delete/update of a key and returns it. The watch stream is closed before WatchOnce returns. Returns the context error if ctx is done first.
+func (rest *Conn) WatchOnce(ctx context.Context, path Path) (*CommitValuePair, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the stream goroutines and closes the connection
+
+	ch, err := rest.watch(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil {
+		return nil, fmt.Errorf("watch %s: invalid stream from Irmin", path.String())
+	}
+	select {
+	case c, ok := <-ch:
+		if !ok {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("watch %s: stream closed", path.String())
+		}
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
+// watch is like Watch, but the stream is closed when ctx is done
+func (rest *Conn) watch(ctx context.Context, path Path) (<-chan *CommitValuePair, error) {
 	uri, err := rest.MakeCallURL("watch", path, true)
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	var ch <-chan *streamReply
-	if ch, err = rest.CallStream(uri, nil); err != nil || ch == nil {
+	if ch, err = rest.callStream(ctx, uri, nil); err != nil || ch == nil {
+		cancel()
 		return nil, err
 	}
 
 	out := make(chan *CommitValuePair, 1)
 
 	go func() {
-		defer close(out)
+		defer func() {
+			cancel() // close the stream if we stop early
+			close(out)
+		}()
 		for m := range ch {
+			if m.err != nil {
+				rest.log.Printf("closing watch: %s\n", m.err)
+				return
+			}
 			p := new([][]Value)
 			if err := json.Unmarshal(m.Result, &p); err != nil {
-				panic(err) // TODO This should be returned to caller
+				rest.log.Printf("closing watch: invalid reply %s: %s\n", m.Result, err)
+				return
 			}
 			for _, q := range *p {
+				if len(q) != 2 {
+					rest.log.Printf("closing watch: expected commit/value pair array of len 2, actual len was %d\n", len(q))
+					return
+				}
 				c := new(CommitValuePair)
-				c.Commit, err = hex.DecodeString(q[0].String())
+				commit, err := hex.DecodeString(q[0].String())
 				if err != nil {
 					rest.log.Printf("Unable to decode commit hash from watch (ignored): %s", q[0].String())
 					continue
 				}
+				c.Commit = commit
 				c.Value = q[1]
-				out <- c
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}()
@@ -445,13 +1285,25 @@ func (rest *Conn) Watch(path Path) (<-chan *CommitValuePair, error) { // TODO no
 
 // WatchPath watches a path recursively. Returns keys that are updated, deleted or created.
 func (rest *Conn) WatchPath(path Path) (<-chan *WatchPathResult, error) { // TODO not path
+	return rest.watchPath(context.Background(), path)
+}
+
+// Tail watches every key in the current tree and returns each change as it is reported by Irmin. Changes arrive in commit order, and the changes in one commit share its hash. Delivery is at-most-once: changes made while the stream is not connected, or before Tail returns, are not reported. The stream is closed when ctx is done or the connection fails.
+func (rest *Conn) Tail(ctx context.Context) (<-chan *WatchPathResult, error) {
+	return rest.watchPath(ctx, Path{})
+}
+
+// watchPath is like WatchPath, but the stream is closed when ctx is done
+func (rest *Conn) watchPath(ctx context.Context, path Path) (<-chan *WatchPathResult, error) {
 	uri, err := rest.MakeCallURL("watch-rec", path, true)
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	var ch <-chan *streamReply
-	if ch, err = rest.CallStream(uri, nil); err != nil || ch == nil {
+	if ch, err = rest.callStream(ctx, uri, nil); err != nil || ch == nil {
+		cancel()
 		return nil, err
 	}
 
@@ -463,19 +1315,26 @@ func (rest *Conn) WatchPath(path Path) (<-chan *WatchPathResult, error) { // TOD
 	}
 
 	go func() {
-		defer close(out)
+		defer func() {
+			cancel() // close the stream if we stop early
+			close(out)
+		}()
 		for m := range ch {
+			if m.err != nil {
+				rest.log.Printf("closing watch-rec: %s\n", m.err)
+				return
+			}
 
 			var q [2]json.RawMessage // array of raw messages
 			if err := json.Unmarshal(m.Result, &q); err != nil {
-				fmt.Printf("json(0): %s\n", m.Result)
-				panic(err) // TODO This should be returned to caller
+				rest.log.Printf("closing watch-rec: invalid reply (0) %s: %s\n", m.Result, err)
+				return
 			}
 
 			var s string // first entry in array is string (commit hash)
 			if err := json.Unmarshal(q[0], &s); err != nil {
-				fmt.Printf("json(1): %s\n", q[0])
-				panic(err) // TODO This should be returned to caller
+				rest.log.Printf("closing watch-rec: invalid reply (1) %s: %s\n", q[0], err)
+				return
 			}
 			commit, err := hex.DecodeString(s)
 			if err != nil {
@@ -485,37 +1344,42 @@ func (rest *Conn) WatchPath(path Path) (<-chan *WatchPathResult, error) { // TOD
 
 			var changes []json.RawMessage // second entry is array of string/path pairs
 			if err := json.Unmarshal(q[1], &changes); err != nil {
-				fmt.Printf("json(2): %s\n", q[1])
-				panic(err) // TODO This should be returned to caller
+				rest.log.Printf("closing watch-rec: invalid reply (2) %s: %s\n", q[1], err)
+				return
 			}
 
 			for _, pair := range changes {
 				var k []json.RawMessage // split pair in hash + path
 				if err := json.Unmarshal(pair, &k); err != nil {
-					fmt.Printf("json(3): %s\n", pair)
-					panic(err) // TODO This should be returned to caller
+					rest.log.Printf("closing watch-rec: invalid reply (3) %s: %s\n", pair, err)
+					return
 				}
 				if len(k) != 2 {
-					panic(fmt.Errorf("Expected string/path pair array of len 2, actual len was %d", len(k)))
+					rest.log.Printf("closing watch-rec: expected string/path pair array of len 2, actual len was %d\n", len(k))
+					return
 				}
 
 				var changetype string
 				if err := json.Unmarshal(k[0], &changetype); err != nil {
-					fmt.Printf("json(4): %s\n", k[0])
-					panic(err) // TODO This should be returned to caller
+					rest.log.Printf("closing watch-rec: invalid reply (4) %s: %s\n", k[0], err)
+					return
 				}
 
 				var key Path
 				if err := json.Unmarshal(k[1], &key); err != nil {
-					fmt.Printf("json(5): %s\n", k[1])
-					panic(err) // TODO This should be returned to caller
+					rest.log.Printf("closing watch-rec: invalid reply (5) %s: %s\n", k[1], err)
+					return
 				}
 
 				c := new(WatchPathResult)
 				c.Commit = commit
 				c.Change = changetype
 				c.Key = key
-				out <- c
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}()
@@ -525,8 +1389,14 @@ func (rest *Conn) WatchPath(path Path) (<-chan *WatchPathResult, error) { // TOD
 
 // Clone the current tree and create a named tag. Force overwrites a previous clone with the same name.
 func (rest *Conn) Clone(t Task, name string, force bool) error {
+	if err := rest.checkWritable(); err != nil {
+		return err
+	}
 	var data cloneReply
 
+	if name == "" {
+		return fmt.Errorf("clone: empty tag name")
+	}
 	path, err := ParseEncodedPath(url.QueryEscape(name)) // encode and wrap in IrminPath
 	if err != nil {
 		return err
@@ -541,30 +1411,58 @@ func (rest *Conn) Clone(t Task, name string, force bool) error {
 		return err
 	}
 
-	body := postRequest{t, nil}
+	body := postRequest{Task: t}
 	if err = rest.Call(uri, &body, &data); err != nil {
 		return err
 	}
-	if data.Error.String() != "" {
-		return fmt.Errorf(data.Error.String())
+	if err = rest.replyError(data.Error); err != nil {
+		return err
 	}
-	if len(data.Result) > 1 {
-		return fmt.Errorf("%s %s returned more than one result", command, name)
+
+	// Irmin replies "ok" on success. Anything else is a failure, e.g. the tag already existed and force was not set.
+	res := data.Result.String()
+	switch {
+	case res == "ok":
+		return nil
+	case res == "":
+		return fmt.Errorf("%s %s returned an empty result", command, name)
+	case !force && (strings.Contains(strings.ToLower(res), "duplicated") || strings.Contains(strings.ToLower(res), "exist")):
+		return fmt.Errorf("%s %s: %w: %s", command, name, ErrRefExists, res)
 	}
-	if (data.Result.String() != "ok") || (data.Result.String() == "" && force) {
-		return fmt.Errorf(data.Result.String())
+	return fmt.Errorf("%s %s failed: %s", command, name, res)
+}
+
+// CloneAndSwitch clones the current tree like Clone and returns a new Conn that operates on the created tag, as if FromTree(name) was called.
+func (rest *Conn) CloneAndSwitch(t Task, name string, force bool) (*Conn, error) {
+	if err := rest.Clone(t, name, force); err != nil {
+		return nil, err
 	}
+	return rest.FromTree(name), nil
+}
 
-	return nil
+// CompareAndSet sets a key if the current value is equal to the given value. A nil oldcontents only sets the key if it does not exist. Returns the commit hash and true if the key was created rather than updated.
+func (rest *Conn) CompareAndSet(t Task, path Path, oldcontents *[]byte, contents *[]byte) (string, bool, error) {
+	return rest.compareAndSet(t, path, oldcontents, contents, nil)
+}
+
+// CompareAndSetWithParents is like CompareAndSet, but the new commit gets the given parent commits instead of the current head. The server must support explicit parents.
+func (rest *Conn) CompareAndSetWithParents(t Task, path Path, oldcontents *[]byte, contents *[]byte, parents []string) (string, bool, error) {
+	if err := validateParents(parents); err != nil {
+		return "", false, err
+	}
+	return rest.compareAndSet(t, path, oldcontents, contents, parents)
 }
 
-// CompareAndSet sets a key if the current value is equal to the given value.
-func (rest *Conn) CompareAndSet(t Task, path Path, oldcontents *[]byte, contents *[]byte) (string, error) {
+// compareAndSet sets a key if the current value is equal to the given value, optionally with explicit parents
+func (rest *Conn) compareAndSet(t Task, path Path, oldcontents *[]byte, contents *[]byte, parents []string) (string, bool, error) {
+	if err := rest.checkWritable(); err != nil {
+		return "", false, err
+	}
 	var data updateReply
 
 	uri, err := rest.MakeCallURL("compare-and-set", path, true)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	var body postRequest
@@ -573,20 +1471,194 @@ func (rest *Conn) CompareAndSet(t Task, path Path, oldcontents *[]byte, contents
 
 	body.Data, err = json.Marshal(&post)
 	if err != nil {
+		return "", false, err
+	}
+
+	body.Task = t
+	body.Parents = parents
+
+	if err = rest.Call(uri, &body, &data); err != nil {
+		return data.Result.String(), false, err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		return "", false, err
+	}
+	if data.Result.String() == "" {
+		return "", false, fmt.Errorf("compare-and-set %s %w", path.String(), errNoCASHash)
+	}
+
+	return data.Result.String(), oldcontents == nil, nil
+}
+
+// errNoCASHash is returned by compareAndSet if Irmin returned no hash, which it does when the current value did not match
+var errNoCASHash = errors.New("seemed to succeed, but didn't return a hash")
+
+// validateHash checks that a commit hash is a non-empty hex string
+func validateHash(hash string) error {
+	if hash == "" {
+		return fmt.Errorf("empty commit hash")
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return fmt.Errorf("invalid commit hash %q: %s", hash, err)
+	}
+	return nil
+}
+
+// validateParents checks a list of parent commit hashes
+func validateParents(parents []string) error {
+	if len(parents) == 0 {
+		return fmt.Errorf("no parent commits")
+	}
+	for _, p := range parents {
+		if err := validateHash(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit creates a new commit with the given parents and updated keys without moving a named branch. The keys in updates are parsed with ParsePath. Returns the hash of the new commit. ErrConflict is returned if Irmin reports a conflict.
+func (rest *Conn) Commit(t Task, parents []string, updates map[string][]byte) (string, error) {
+	if err := rest.checkWritable(); err != nil {
 		return "", err
 	}
+	var data commitReply
+	var err error
+
+	for _, p := range parents { // no parents creates a root commit
+		if err = validateHash(p); err != nil {
+			return "", err
+		}
+	}
+
+	keys := make([]string, 0, len(updates))
+	for k := range updates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // send updates in a predictable order
 
+	type pathValue [2]interface{}
+	var params struct {
+		Contents []pathValue `json:"contents"`
+	}
+	params.Contents = make([]pathValue, len(keys))
+	for i, k := range keys {
+		v := Value(updates[k])
+		params.Contents[i] = pathValue{ParsePath(k), &v}
+	}
+
+	var body postRequest
 	body.Task = t
+	body.Parents = parents // sent like the parents of UpdateWithParents
+	if body.Data, err = json.Marshal(&params); err != nil {
+		return "", err
+	}
 
+	uri, err := rest.MakeCallURL("commit", Path{}, false)
+	if err != nil {
+		return "", err
+	}
 	if err = rest.Call(uri, &body, &data); err != nil {
-		return data.Result.String(), err
+		return "", err
 	}
-	if data.Error.String() != "" {
-		return "", fmt.Errorf(data.Error.String())
+	if err = rest.replyError(data.Error); err != nil {
+		return "", err
 	}
 	if data.Result.String() == "" {
-		return "", fmt.Errorf("compare-and-set seemed to succeed, but didn't return a hash", path.String(), data.Result.String())
+		return "", fmt.Errorf("commit seemed to succeed, but didn't return a hash")
 	}
 
 	return data.Result.String(), nil
 }
+
+// Sync asks Irmin to flush buffered writes to durable storage. Returns ErrUnsupported if the server has no sync command. The standard Irmin backends persist each commit as it is made (or, for the in-memory backend, never), so only servers with a buffering backend provide this command.
+func (rest *Conn) Sync() error {
+	var data syncReply
+	ok, err := rest.SupportsCommand("sync")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("sync: %w", ErrUnsupported)
+	}
+	uri, err := rest.MakeCallURL("sync", Path{}, false)
+	if err != nil {
+		return err
+	}
+	body := postRequest{Task: rest.NewTask("sync")}
+	if err = rest.Call(uri, &body, &data); err != nil {
+		return err
+	}
+	return rest.replyError(data.Error)
+}
+
+// Abort asks the server to cancel the long-running operation opID, e.g. a merge or import started by this client. Returns ErrUnsupported if the server has no abort command. The standard Irmin server runs each command to completion and has no cancellable operations, so none of the methods in this package return operation IDs: opID must come from a server extension that reports them.
+func (rest *Conn) Abort(opID string) error {
+	if err := rest.checkWritable(); err != nil {
+		return err
+	}
+	if opID == "" {
+		return fmt.Errorf("abort: empty operation id")
+	}
+	var data abortReply
+	ok, err := rest.SupportsCommand("abort")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("abort: %w", ErrUnsupported)
+	}
+	uri, err := rest.MakeCallURL("abort", Path{}, false)
+	if err != nil {
+		return err
+	}
+	body := postRequest{Task: rest.NewTask("abort " + opID)}
+	id := Value(opID)
+	if body.Data, err = id.MarshalJSON(); err != nil {
+		return err
+	}
+	if err = rest.Call(uri, &body, &data); err != nil {
+		return err
+	}
+	return rest.replyError(data.Error)
+}
+
+type gcReply struct {
+	Result  json.Number
+	Error   errorValue
+	Version Value
+}
+
+// GC asks the server to delete commits and objects that can't be reached from any tag, e.g. after branches were removed. Returns the number of objects removed, or ErrUnsupported if the server has no gc command, which is the case for the standard Irmin REST server. Collection may take a long time on large stores and the call blocks until it is done; use a server extension that supports Abort to cancel it.
+func (rest *Conn) GC() (removed int, err error) {
+	if err = rest.checkWritable(); err != nil {
+		return 0, err
+	}
+	var data gcReply
+	ok, err := rest.SupportsCommand("gc")
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("gc: %w", ErrUnsupported)
+	}
+	uri, err := rest.MakeCallURL("gc", Path{}, false)
+	if err != nil {
+		return 0, err
+	}
+	body := postRequest{Task: rest.NewTask("gc")}
+	if err = rest.Call(uri, &body, &data); err != nil {
+		return 0, err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		return 0, err
+	}
+	if data.Result == "" {
+		return 0, nil
+	}
+	n, err := data.Result.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("gc: invalid result %q", data.Result)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,586 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestKeepAlive(t *testing.T) {
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/read/a":
+			fmt.Fprint(w, `{"result":["v"]}`)
+		case "/iter":
+			fmt.Fprint(w, `[{"stream":"start"},{"version":"0.9"},{"result":["a"]},{"stream":"end"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	var dials int64
+	c.SetTransport(&http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt64(&dials, 1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	})
+
+	for i := 0; i < 50; i++ {
+		if _, err := c.Read(ParsePath("a")); err != nil {
+			t.Fatal(err)
+		}
+		ch, err := c.IterResults(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r := range ch {
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+		}
+	}
+	if n := atomic.LoadInt64(&dials); n != 1 {
+		t.Fatalf("%d connections were dialed for 100 sequential requests, expected 1", n)
+	}
+}
+
+func TestFromTreeURL(t *testing.T) {
+	c := Create(&url.URL{Scheme: "http", Host: "irmin"}, "test")
+	for _, tc := range []struct {
+		tree         string
+		supportsTree bool
+		want         string
+	}{
+		{"", true, "http://irmin/read/a/b"},
+		{"feature", true, "http://irmin/tree/feature/read/a/b"},
+		{"feature/x", true, "http://irmin/tree/feature%2Fx/read/a/b"},
+		{"feature", false, "http://irmin/read/a/b"},
+	} {
+		uri, err := c.FromTree(tc.tree).MakeCallURL("read", ParsePath("a/b"), tc.supportsTree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uri.String() != tc.want {
+			t.Errorf("tree %q: got %s, expected %s", tc.tree, uri, tc.want)
+		}
+	}
+}
+
+func TestHandshakeCache(t *testing.T) {
+	var requests int64
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		fmt.Fprint(w, `{"result":["read","update"],"version":"0.10.0"}`)
+	})
+	version, cmds, err := c.Handshake()
+	if err != nil || version != "0.10.0" || len(cmds) != 2 {
+		t.Fatalf("got %q, %q, %v from Handshake", version, cmds, err)
+	}
+	if ok, err := c.SupportsCommand("update"); err != nil || !ok {
+		t.Fatalf("got %v, %v from SupportsCommand", ok, err)
+	}
+	if v, err := c.FromTree("other").ServerVersion(); err != nil || v != "0.10.0" {
+		t.Fatalf("got %q, %v from ServerVersion", v, err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Fatalf("%d requests, expected the handshake to be reused", n)
+	}
+	c.InvalidateCommands()
+	if _, err := c.ServerVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Fatalf("%d requests, expected a new handshake after InvalidateCommands", n)
+	}
+}
+
+func TestUpdateDeepErrors(t *testing.T) {
+	for _, tc := range []struct {
+		reply  string
+		parent bool
+	}{
+		{`{"error":{"code":"invalid_path","message":"parent a is not a directory"}}`, true},
+		{`{"error":{"code":"conflict","message":"conflict"}}`, false},
+		{`{"error":{"message":"permission denied"}}`, false},
+	} {
+		c := testConn(t, testStream(tc.reply))
+		_, err := c.UpdateDeep(c.NewTask("deep"), ParsePath("a/b/c"), []byte("x"))
+		if err == nil {
+			t.Fatalf("%s: no error", tc.reply)
+		}
+		if got := strings.Contains(err.Error(), "parents"); got != tc.parent {
+			t.Errorf("%s: got %v, expected it to be reported as a parent error: %v", tc.reply, err, tc.parent)
+		}
+	}
+	c := testConn(t, testStream(`{"error":{"code":"conflict","message":"conflict"}}`))
+	if _, err := c.UpdateDeep(c.NewTask("deep"), ParsePath("a/b"), []byte("x")); !errors.Is(err, ErrConflict) {
+		t.Errorf("got %v, expected ErrConflict", err)
+	}
+}
+
+func TestZeroConn(t *testing.T) {
+	var c Conn
+	checks := map[string]func() error{
+		"Read": func() error {
+			_, err := c.Read(ParsePath("a"))
+			return err
+		},
+		"Update": func() error {
+			_, err := c.Update(c.NewTask("zero"), ParsePath("a"), []byte("x"))
+			return err
+		},
+		"IterResults": func() error {
+			_, err := c.IterResults(context.Background())
+			return err
+		},
+		"SupportsCommand": func() error {
+			_, err := c.SupportsCommand("watch")
+			return err
+		},
+		"MakeCallURL": func() error {
+			_, err := c.MakeCallURL("read", ParsePath("a"), true)
+			return err
+		},
+	}
+	for name, check := range checks {
+		if err := check(); !errors.Is(err, ErrNotInitialized) {
+			t.Errorf("%s: got %v, expected ErrNotInitialized", name, err)
+		}
+	}
+	if c.BaseURI() != nil || c.ActiveServer() != nil {
+		t.Error("zero Conn has a server URL")
+	}
+}
+
+func TestPathEncoder(t *testing.T) {
+	c := Create(&url.URL{Scheme: "http", Host: "irmin"}, "test")
+	c.SetPathEncoder(func(path Path) string {
+		if len(path) == 0 {
+			return ""
+		}
+		steps := make([]string, len(path))
+		for i, step := range path {
+			steps[i] = url.PathEscape(step.String())
+		}
+		return "/" + strings.Join(steps, ":")
+	})
+	for _, tc := range []struct {
+		path Path
+		want string
+	}{
+		{Path{}, "http://irmin/read"},
+		{ParsePath("a"), "http://irmin/read/a"},
+		{ParsePath("a/b/c"), "http://irmin/read/a:b:c"},
+		{Path{Value("x y"), Value("z")}, "http://irmin/read/x%20y:z"},
+	} {
+		uri, err := c.MakeCallURL("read", tc.path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uri.String() != tc.want {
+			t.Errorf("%v: got %s, expected %s", tc.path, uri, tc.want)
+		}
+	}
+	uri, err := c.FromTree("dev").MakeCallURL("read", ParsePath("a/b"), true)
+	if err != nil || uri.String() != "http://irmin/tree/dev/read/a:b" {
+		t.Errorf("got %v, %v with a tree", uri, err)
+	}
+
+	c.SetPathEncoder(nil)
+	if uri, _ = c.MakeCallURL("read", ParsePath("a/b"), true); uri.String() != "http://irmin/read/a/b" {
+		t.Errorf("got %s after resetting the encoder", uri)
+	}
+}
+
+func TestRootPathURLs(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.URL.EscapedPath())
+		mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/iter"):
+			fmt.Fprint(w, `[{"stream":"start"},{"version":"0.9"},{"stream":"end"}]`)
+		case strings.HasSuffix(r.URL.Path, "/update"):
+			fmt.Fprint(w, `{"result":"abcd"}`)
+		default:
+			fmt.Fprint(w, `{"result":[]}`)
+		}
+	})
+	for _, p := range []string{"", "/"} {
+		if root := ParsePath(p); len(root) != 0 {
+			t.Fatalf("ParsePath(%q) has %d steps, expected the root", p, len(root))
+		}
+	}
+	for _, tree := range []string{"", "dev"} {
+		conn := c.FromTree(tree)
+		if _, err := conn.List(Path{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.TryRead(Path{}); err != nil {
+			t.Fatal(err)
+		}
+		ch, err := conn.IterResults(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r := range ch {
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+		}
+		if _, err := conn.Update(conn.NewTask("root"), Path{}, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"/list", "/read", "/iter", "/update", "/tree/dev/list", "/tree/dev/read", "/tree/dev/iter", "/tree/dev/update"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got requests %q, expected %q", got, want)
+	}
+}
+
+func TestReplyDecoderCopies(t *testing.T) {
+	c := testConn(t, testStream(`{"result":["json"]}`))
+	custom := func(body []byte, v interface{}) error {
+		return json.Unmarshal([]byte(`{"result":["custom"]}`), v)
+	}
+	c.SetReplyDecoder("read", custom)
+	copied := c.FromTree("dev")
+	c.SetReplyDecoder("read", nil)
+
+	if v, err := c.Read(ParsePath("a")); err != nil || string(v) != "json" {
+		t.Errorf("got %q, %v after removing the decoder", v, err)
+	}
+	if v, err := copied.Read(ParsePath("a")); err != nil || string(v) != "custom" {
+		t.Errorf("got %q, %v from the copy, expected it to keep its decoder", v, err)
+	}
+}
+
+func TestReadSnapshotKeys(t *testing.T) {
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/head":
+			fmt.Fprint(w, `{"result":["abcd"]}`)
+		case "/tree/abcd/read/a/b":
+			fmt.Fprint(w, `{"result":["nested"]}`)
+		case "/tree/abcd/read/a%2Fb":
+			fmt.Fprint(w, `{"result":["slash"]}`)
+		default:
+			fmt.Fprint(w, `{"result":[]}`)
+		}
+	})
+	nested := ParsePath("a/b")
+	slash := Path{Value("a/b")}
+	values, commit, err := c.ReadSnapshot([]Path{nested, slash, ParsePath("missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit != "abcd" || len(values) != 2 {
+		t.Fatalf("got %q at %s", values, commit)
+	}
+	if string(values[nested.URL().String()]) != "nested" || string(values[slash.URL().String()]) != "slash" {
+		t.Fatalf("got %q, expected a/b and a%%2Fb to be separate keys", values)
+	}
+}
+
+func TestReadRaw(t *testing.T) {
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/read/marshal" {
+			w.Header().Set("Content-Type", "application/x-ocaml-marshal")
+			w.Write([]byte{0x84, 0x95, 0xa6, 0xbe})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"result":["json"]}`)
+	})
+	v, contentType, err := c.ReadRaw(ParsePath("marshal"))
+	if err != nil || contentType != "application/x-ocaml-marshal" || !bytes.Equal(v, []byte{0x84, 0x95, 0xa6, 0xbe}) {
+		t.Errorf("got %x, %q, %v for a non-JSON value", v, contentType, err)
+	}
+	c.SetReplyDecoder("read", func(body []byte, v interface{}) error {
+		return json.Unmarshal([]byte(`{"result":["decoded"]}`), v)
+	})
+	if v, contentType, err = c.ReadRaw(ParsePath("a")); err != nil || contentType != "application/json" || string(v) != "decoded" {
+		t.Errorf("got %q, %q, %v, expected the reply decoder to be used", v, contentType, err)
+	}
+}
+
+func TestParentsInEnvelope(t *testing.T) {
+	var body struct {
+		Parents []string
+		Params  json.RawMessage
+	}
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		body.Parents, body.Params = nil, nil
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		fmt.Fprint(w, `{"result":"abcd"}`)
+	})
+	parents := []string{"0123", "4567"}
+	check := func(what string) {
+		t.Helper()
+		if fmt.Sprint(body.Parents) != fmt.Sprint(parents) {
+			t.Errorf("%s: got parents %q, expected %q", what, body.Parents, parents)
+		}
+	}
+
+	if _, err := c.UpdateWithParents(c.NewTask("update"), ParsePath("a"), []byte("x"), parents); err != nil {
+		t.Fatal(err)
+	}
+	check("UpdateWithParents")
+	if _, err := c.Commit(c.NewTask("commit"), parents, map[string][]byte{"a": []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	check("Commit")
+	if bytes.Contains(body.Params, []byte("parents")) {
+		t.Errorf("Commit sent the parents in the params too: %s", body.Params)
+	}
+
+	// a custom envelope gets the parents to encode
+	c.SetEnvelopeEncoder(func(task *Task, params json.RawMessage, parents []string) ([]byte, error) {
+		return json.Marshal(map[string]interface{}{"params": params, "parents": parents})
+	})
+	if _, _, err := c.CompareAndSetWithParents(c.NewTask("cas"), ParsePath("a"), nil, &[]byte{'x'}, parents); err != nil {
+		t.Fatal(err)
+	}
+	check("CompareAndSetWithParents with an envelope encoder")
+}
+
+func TestEnvelopeEncoderTask(t *testing.T) {
+	var got []byte
+	c := testConn(t, testStream(`{"result":"abcd"}`))
+	c.SetEnvelopeEncoder(func(task *Task, params json.RawMessage, parents []string) ([]byte, error) {
+		b, err := json.Marshal(task)
+		got = b
+		return b, err
+	})
+	if _, err := c.Update(c.NewTask("update"), ParsePath("a"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(got, []byte(`"owner":"test"`)) {
+		t.Fatalf("got task %s, expected the owner as a string", got)
+	}
+}
+
+func TestUnknownRef(t *testing.T) {
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tree/missing/read/a" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"error":"Unknown tag: missing"}`)
+	})
+	_, err := c.FromTree("missing").Read(ParsePath("a"))
+	var uerr *UnknownRefError
+	if !errors.Is(err, ErrUnknownRef) || !errors.As(err, &uerr) {
+		t.Fatalf("got %v, expected ErrUnknownRef", err)
+	}
+	if uerr.Ref != "missing" || uerr.Msg != "Unknown tag: missing" {
+		t.Fatalf("got ref %q and message %q", uerr.Ref, uerr.Msg)
+	}
+}
+
+func TestClone(t *testing.T) {
+	for _, tc := range []struct {
+		force   bool
+		result  string
+		request string
+		ok      bool
+		exists  bool // ErrRefExists expected
+	}{
+		{false, `"ok"`, "/clone/dev", true, false},
+		{true, `"ok"`, "/clone-force/dev", true, false},
+		{false, `""`, "/clone/dev", false, false},
+		{false, `"duplicated tag"`, "/clone/dev", false, true},
+		{true, `"duplicated tag"`, "/clone-force/dev", false, false},
+	} {
+		var request string
+		c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+			request = r.URL.Path
+			fmt.Fprintf(w, `{"result":%s}`, tc.result)
+		})
+		err := c.Clone(c.NewTask("clone"), "dev", tc.force)
+		if request != tc.request {
+			t.Errorf("force %v: got request %s, expected %s", tc.force, request, tc.request)
+		}
+		if (err == nil) != tc.ok || errors.Is(err, ErrRefExists) != tc.exists {
+			t.Errorf("force %v, result %s: got %v", tc.force, tc.result, err)
+		}
+	}
+}
+
+func TestNotFoundStatus(t *testing.T) {
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	if _, err := c.Read(ParsePath("a")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v from Read, expected ErrNotFound", err)
+	}
+	if v, found, err := c.TryRead(ParsePath("a")); err != nil || found {
+		t.Errorf("got %q, %v, %v from TryRead, expected the key not to be found", v, found, err)
+	}
+	if v, err := c.ReadOrDefault(ParsePath("a"), []byte("def")); err != nil || string(v) != "def" {
+		t.Errorf("got %q, %v from ReadOrDefault, expected the default", v, err)
+	}
+}
+
+func TestCompressRequests(t *testing.T) {
+	var encoding string
+	var got []byte
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		var body io.Reader = r.Body
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = zr
+		}
+		var req struct{ Params Value }
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		got = req.Params
+		fmt.Fprint(w, `{"result":"abcd"}`)
+	})
+	c.SetCompressRequests(1024)
+
+	large := bytes.Repeat([]byte("large value "), 10000)
+	if _, err := c.Update(c.NewTask("large"), ParsePath("a"), large); err != nil {
+		t.Fatal(err)
+	}
+	if encoding != "gzip" || !bytes.Equal(got, large) {
+		t.Errorf("got Content-Encoding %q and %d bytes, expected %d gzipped bytes", encoding, len(got), len(large))
+	}
+
+	if _, err := c.Update(c.NewTask("small"), ParsePath("a"), []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if encoding != "" || string(got) != "small" {
+		t.Errorf("got Content-Encoding %q and %q, expected a small body not to be compressed", encoding, got)
+	}
+}
+
+func TestMakeCallURLWithParams(t *testing.T) {
+	base, _ := url.Parse("http://irmin:8080")
+	c := Create(base, "test").FromTree("dev")
+	for _, tc := range []struct {
+		params url.Values
+		want   string
+	}{
+		{nil, "http://irmin:8080/tree/dev/list/a%2Fb/c"},
+		{url.Values{}, "http://irmin:8080/tree/dev/list/a%2Fb/c"},
+		{url.Values{"depth": {"2"}}, "http://irmin:8080/tree/dev/list/a%2Fb/c?depth=2"},
+		{url.Values{"recursive": {"true"}, "depth": {"2"}}, "http://irmin:8080/tree/dev/list/a%2Fb/c?depth=2&recursive=true"},
+		{url.Values{"q": {"a b&c=d/é"}, "multi": {"1", "2"}}, "http://irmin:8080/tree/dev/list/a%2Fb/c?multi=1&multi=2&q=a+b%26c%3Dd%2F%C3%A9"},
+	} {
+		u, err := c.MakeCallURLWithParams("list", Path{NewValue("a/b"), NewValue("c")}, true, tc.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.String() != tc.want {
+			t.Errorf("%v: got %s, expected %s", tc.params, u.String(), tc.want)
+		}
+	}
+
+	// the server receives the decoded values
+	var got url.Values
+	s := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()
+		fmt.Fprint(w, `{"result":[]}`)
+	})
+	u, err := s.MakeCallURLWithParams("list", Path{}, true, url.Values{"q": {"a b&c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data listReply
+	if err = s.Call(u, nil, &data); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("q") != "a b&c" {
+		t.Errorf("server got query %v", got)
+	}
+}
+
+func TestSortResults(t *testing.T) {
+	c := testConn(t, testStream(`{"result":[["d","b"],["d","B"],["d","a","z"],["d","a"],["d","a","b"]]}`))
+	list := func() string {
+		t.Helper()
+		paths, err := c.List(ParsePath("d"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r []string
+		for _, p := range paths {
+			r = append(r, p.String())
+		}
+		return fmt.Sprint(r)
+	}
+	if got, want := list(), "[/d/b /d/B /d/a/z /d/a /d/a/b]"; got != want {
+		t.Errorf("got %s, expected the order of the reply %s", got, want)
+	}
+	c.SetSortResults(true)
+	// byte order puts upper case first, and a path sorts before the paths below it
+	if got, want := list(), "[/d/B /d/a /d/a/b /d/a/z /d/b]"; got != want {
+		t.Errorf("got %s, expected %s", got, want)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tree/dev/head":
+			fmt.Fprint(w, `{"result":["abcd"]}`)
+		case "/tree/empty/head": // a tag without a head
+			fmt.Fprint(w, `{"result":[]}`)
+		case "/tree/missing/head":
+			fmt.Fprint(w, `{"error":"Unknown tag: missing"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	if hash, err := c.Resolve("dev"); err != nil || hash != "abcd" {
+		t.Errorf("got %q, %v, expected abcd", hash, err)
+	}
+	for _, ref := range []string{"empty", "missing"} {
+		hash, err := c.Resolve(ref)
+		var uerr *UnknownRefError
+		if !errors.Is(err, ErrUnknownRef) || !errors.As(err, &uerr) || uerr.Ref != ref {
+			t.Errorf("%s: got %q, %v, expected an unknown ref error for %s", ref, hash, err, ref)
+		}
+	}
+	if _, err := c.Resolve(""); err == nil {
+		t.Error("an empty ref was resolved")
+	}
+}
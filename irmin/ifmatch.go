@@ -0,0 +1,62 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// contentHash returns the hex-encoded Git blob hash of a value, the SHA1 of "blob <size>\x00" followed by the value. This is the hash Irmin's Git backend stores the value under.
+func contentHash(v []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(v))
+	h.Write(v)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// UpdateIfMatch sets a key if the hash of its current value is expectedContentHash, like an HTTP If-Match header. The hash is computed by HashContents, so by default it is the hex-encoded Git blob hash. An empty expectedContentHash only sets the key if it does not exist and a nil contents removes the key. Irmin can't compare hashes itself, so the current value is read and then written back with CompareAndSet, which still sends the old value to the server. Returns the commit hash, or an error wrapping ErrConflict if the hash does not match or the value changed in between.
+func (rest *Conn) UpdateIfMatch(t Task, path Path, contents *[]byte, expectedContentHash string) (string, error) {
+	if err := rest.checkWritable(); err != nil {
+		return "", err
+	}
+	old, found, err := rest.TryRead(path)
+	if err != nil {
+		return "", err
+	}
+	var oldcontents *[]byte
+	if found {
+		oldHash, err := rest.HashContents(old)
+		if err != nil {
+			return "", err
+		}
+		if !strings.EqualFold(oldHash, expectedContentHash) {
+			return "", fmt.Errorf("update %s: content hash is %s, expected %q: %w", path.String(), oldHash, expectedContentHash, ErrConflict)
+		}
+		oldcontents = &old
+	} else if expectedContentHash != "" {
+		return "", fmt.Errorf("update %s: key does not exist, expected content hash %s: %w", path.String(), expectedContentHash, ErrConflict)
+	}
+	hash, _, err := rest.CompareAndSet(t, path, oldcontents, contents)
+	if errors.Is(err, errNoCASHash) {
+		return "", fmt.Errorf("update %s: value changed: %w", path.String(), ErrConflict)
+	}
+	return hash, err
+}
@@ -0,0 +1,81 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// IterMap iterates through all keys in the database and calls fn for each key from concurrency goroutines, e.g. to read the values of all keys in parallel. fn must be safe to call concurrently. The first error returned by fn stops the iteration and no new calls are started, but calls that are already running are finished. All errors returned by fn are then returned together, each as a *PathError, joined with errors.Join. Cancelling ctx also stops the iteration and returns the context error.
+func (rest *Conn) IterMap(ctx context.Context, fn func(path Path) error, concurrency int) error {
+	if concurrency < 1 {
+		return fmt.Errorf("invalid concurrency %d", concurrency)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stop the stream if we return early
+
+	ch, err := rest.IterResults(ctx)
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex // protects errs
+	var errs []error
+	paths := make(chan Path)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range paths {
+				if err := fn(p); err != nil {
+					mu.Lock()
+					errs = append(errs, &PathError{Path: p, Err: err})
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+
+	var streamErr error
+loop:
+	for r := range ch {
+		if r.Err != nil {
+			streamErr = r.Err
+			break
+		}
+		select {
+		case paths <- r.Path:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(paths)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return streamErr
+}
@@ -0,0 +1,133 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// MergeStrategy selects how Merge resolves changes made to the same key on both branches
+type MergeStrategy string
+
+const (
+	// MergeDefault is Irmin's three-way merge, which fails with a conflict if both branches changed a key differently
+	MergeDefault MergeStrategy = ""
+	// MergeOurs keeps the value of the current tree for conflicting keys
+	MergeOurs MergeStrategy = "ours"
+	// MergeTheirs takes the value of the merged branch for conflicting keys
+	MergeTheirs MergeStrategy = "theirs"
+)
+
+// mergeResult is the result of a merge. Irmin returns { "ok": ... } or { "conflict": message }, servers with the merge command may also list the conflicting keys.
+type mergeResult struct {
+	OK        *Value `json:"ok"`
+	Conflict  *Value `json:"conflict"`
+	Conflicts []Path `json:"conflicts"`
+	Commit    Value  `json:"commit"`
+}
+
+type mergeReply struct {
+	Result  json.RawMessage
+	Error   errorValue
+	Version Value
+}
+
+// Merge merges branch into the current tree and returns the hash of the merge commit, which the server must report in its reply. MergeDefault uses Irmin's merge-tag command, which all Irmin versions provide. Irmin itself has no other strategies, so MergeOurs and MergeTheirs are only available from servers that provide a merge command accepting a strategy, and return ErrUnsupported otherwise. If the branches conflict a *MergeConflictError is returned, which lists the conflicting keys if the server reported them. If branch does not exist an *UnknownRefError for branch is returned.
+func (rest *Conn) Merge(t Task, branch string, strategy MergeStrategy) (string, error) {
+	if err := rest.checkWritable(); err != nil {
+		return "", err
+	}
+	if branch == "" {
+		return "", fmt.Errorf("merge: empty branch name")
+	}
+
+	var data mergeReply
+	var body postRequest
+	body.Task = t
+	var uri *url.URL
+	var err error
+	switch strategy {
+	case MergeDefault:
+		uri, err = rest.MakeCallURL("merge-tag", Path{NewValue(branch)}, true)
+	case MergeOurs, MergeTheirs:
+		var ok bool
+		ok, err = rest.SupportsCommand("merge")
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("merge with strategy %s: %w", strategy, ErrUnsupported)
+		}
+		params := struct {
+			Branch   string        `json:"branch"`
+			Strategy MergeStrategy `json:"strategy"`
+		}{branch, strategy}
+		if body.Data, err = json.Marshal(&params); err != nil {
+			return "", err
+		}
+		uri, err = rest.MakeCallURL("merge", Path{}, true)
+	default:
+		return "", fmt.Errorf("merge: unknown strategy %q", strategy)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err = rest.Call(uri, &body, &data); err != nil {
+		return "", err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		var serr *ServerError
+		if errors.Is(err, ErrConflict) && errors.As(err, &serr) {
+			return "", &MergeConflictError{Branch: branch, Msg: serr.Message}
+		}
+		var uerr *UnknownRefError
+		if errors.As(err, &uerr) && (strings.Contains(uerr.Msg, branch) || !strings.Contains(uerr.Msg, uerr.Ref)) {
+			return "", &UnknownRefError{Ref: branch, Msg: uerr.Msg} // the merged branch is missing, not the current tree
+		}
+		return "", err
+	}
+	var r mergeResult
+	switch {
+	case len(data.Result) > 0 && data.Result[0] == '{':
+		if err = json.Unmarshal(data.Result, &r); err != nil {
+			return "", fmt.Errorf("merge %s: invalid result %s", branch, data.Result)
+		}
+	case len(data.Result) > 0 && data.Result[0] == '"': // just the hash
+		if err = json.Unmarshal(data.Result, &r.Commit); err != nil {
+			return "", fmt.Errorf("merge %s: invalid result %s", branch, data.Result)
+		}
+	}
+	if r.Conflict != nil || len(r.Conflicts) > 0 {
+		e := &MergeConflictError{Branch: branch, Paths: r.Conflicts}
+		if r.Conflict != nil {
+			e.Msg = r.Conflict.String()
+		}
+		return "", e
+	}
+	if r.Commit.String() == "" && r.OK != nil {
+		r.Commit = *r.OK
+	}
+	if err = validateHash(r.Commit.String()); err != nil { // the head is not read instead, as it may already include other commits
+		return "", fmt.Errorf("merge %s seemed to succeed, but didn't return the merge commit: %s", branch, data.Result)
+	}
+	return r.Commit.String(), nil
+}
@@ -0,0 +1,88 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	for _, tc := range []struct {
+		strategy MergeStrategy
+		commands string // reply to the command list
+		reply    string
+		request  string // expected path of the merge request
+		hash     string
+		err      error
+	}{
+		{MergeDefault, `[]`, `{"result":"abcd"}`, "/merge-tag/dev", "abcd", nil},
+		{MergeDefault, `[]`, `{"result":{"ok":"abcd"}}`, "/merge-tag/dev", "abcd", nil},
+		{MergeDefault, `[]`, `{"result":{"conflict":"a/b"}}`, "/merge-tag/dev", "", ErrConflict},
+		{MergeDefault, `[]`, `{"error":{"code":"conflict","message":"conflict"}}`, "/merge-tag/dev", "", ErrConflict},
+		{MergeTheirs, `["merge"]`, `{"result":{"commit":"abcd"}}`, "/merge", "abcd", nil},
+		{MergeTheirs, `["merge"]`, `{"result":{"conflicts":[["a"],["b"]]}}`, "/merge", "", ErrConflict},
+		{MergeOurs, `["read"]`, ``, "", "", ErrUnsupported},
+	} {
+		var request, params string
+		c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				fmt.Fprintf(w, `{"result":%s}`, tc.commands)
+				return
+			}
+			request = r.URL.Path
+			body, _ := ioutil.ReadAll(r.Body)
+			params = string(body)
+			fmt.Fprint(w, tc.reply)
+		})
+		hash, err := c.Merge(c.NewTask("merge"), "dev", tc.strategy)
+		if request != tc.request || hash != tc.hash || !errors.Is(err, tc.err) {
+			t.Errorf("%q %s: got %s, %q, %v, expected %s, %q, %v", tc.strategy, tc.reply, request, hash, err, tc.request, tc.hash, tc.err)
+		}
+		if tc.strategy != MergeDefault && tc.err != ErrUnsupported && !strings.Contains(params, `"strategy":"theirs"`) {
+			t.Errorf("%q: strategy not sent in %s", tc.strategy, params)
+		}
+		var conflict *MergeConflictError
+		if errors.As(err, &conflict) && strings.Contains(tc.reply, "conflicts") && len(conflict.Paths) != 2 {
+			t.Errorf("got conflicting paths %v, expected a and b", conflict.Paths)
+		}
+	}
+
+	c := testConn(t, testStream(`{"result":{}}`))
+	if _, err := c.Merge(c.NewTask("merge"), "dev", MergeDefault); err == nil {
+		t.Error("a merge without a commit hash in the reply succeeded")
+	}
+}
+
+func TestMergeUnknownBranch(t *testing.T) {
+	for reply, ref := range map[string]string{
+		`{"error":{"message":"unknown tag dev"}}`:    "dev",
+		`{"error":{"message":"unknown tag"}}`:        "dev",
+		`{"error":{"message":"unknown tag master"}}`: "master", // the current tree is missing
+	} {
+		c := testConn(t, testStream(reply))
+		_, err := c.Merge(c.NewTask("merge"), "dev", MergeDefault)
+		var uerr *UnknownRefError
+		if !errors.Is(err, ErrUnknownRef) || !errors.As(err, &uerr) || uerr.Ref != ref {
+			t.Errorf("%s: got %v, expected an unknown ref error for %s", reply, err, ref)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// MovePrefix moves every key below from to the same position below to, e.g. a/b/c becomes x/b/c when moving a to x. The keys are copied and removed in a view, which is then merged into the current tree, so the move is a single commit. The keys to move are listed from the current head, one level at a time. Returns the hash of the merge commit, or "" if the server did not report it; the head is not read afterwards, as it may already include other writers' commits. If any of the destination keys already exists nothing is changed and an error wrapping ErrConflict is returned. ErrNotFound is returned if there are no keys below from.
+func (rest *Conn) MovePrefix(t Task, from, to Path) (string, error) {
+	if err := rest.checkWritable(); err != nil {
+		return "", err
+	}
+	if len(from) == 0 || len(to) == 0 {
+		return "", fmt.Errorf("move: can't move to or from the root")
+	}
+	if from.HasPrefix(to) || to.HasPrefix(from) {
+		return "", fmt.Errorf("move %s to %s: paths overlap", from.String(), to.String())
+	}
+
+	head, err := rest.Head()
+	if err != nil {
+		return "", err
+	}
+	at := rest.AtCommit(hex.EncodeToString(head)) // list the keys from one commit
+
+	// list the subtree level by level, so the work does not depend on the size of the rest of the store
+	below, err := at.listRecursive(from, -1)
+	if err != nil {
+		return "", err
+	}
+	var keys []Path
+	for _, k := range append([]Path{from}, below...) { // from itself may have a value
+		_, found, err := at.TryRead(k)
+		if err != nil {
+			return "", err
+		}
+		if found { // skip nodes that only have children
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("move %s: %w", from.String(), ErrNotFound)
+	}
+
+	dests := make([]Path, len(keys))
+	for i, k := range keys {
+		rel, _ := k.TrimPrefix(from)
+		dests[i] = append(append(Path{}, to...), rel...)
+		exists, err := rest.Mem(dests[i])
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return "", fmt.Errorf("move %s to %s: %s: %w", from.String(), to.String(), dests[i].String(), ErrConflict)
+		}
+	}
+
+	view, err := rest.CreateView(t, Path{})
+	if err != nil {
+		return "", err
+	}
+	for i, k := range keys {
+		v, err := view.Read(k)
+		if err != nil {
+			return "", err
+		}
+		if _, err = view.Update(t, dests[i], v); err != nil {
+			return "", err
+		}
+		if err = view.Remove(t, k); err != nil {
+			return "", err
+		}
+	}
+	return view.mergePath(t, rest.Tree(), Path{})
+}
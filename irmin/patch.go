@@ -0,0 +1,129 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxPatchAttempts is the number of times PatchJSON tries to write a value before giving up
+const maxPatchAttempts = 5
+
+// PatchJSON sets the element at pointer in the JSON document stored at path to value, which is encoded with encoding/json. pointer is a JSON pointer (RFC 6901), e.g. /servers/0/name. The empty pointer replaces the whole document. Object members are created if they don't exist, and array elements are replaced, or appended if the last step is "-". The document is written with CompareAndSet, so concurrent changes are not lost: if the value changed since it was read, it is read and patched again, up to 5 times, before an error wrapping ErrConflict is returned. Returns the commit hash.
+func (rest *Conn) PatchJSON(t Task, path Path, pointer string, value interface{}) (string, error) {
+	if err := rest.checkWritable(); err != nil {
+		return "", err
+	}
+	steps, err := parseJSONPointer(pointer)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	var v interface{}
+	if err = decodeJSON(b, &v); err != nil {
+		return "", err
+	}
+
+	for i := 0; i < maxPatchAttempts; i++ {
+		old, err := rest.Read(path)
+		if err != nil {
+			return "", err
+		}
+		var doc interface{}
+		if err = decodeJSON(old, &doc); err != nil {
+			return "", fmt.Errorf("%s does not contain a JSON document: %s", path.String(), err)
+		}
+		if doc, err = setJSONPointer(doc, steps, v); err != nil {
+			return "", fmt.Errorf("patch %s: %s", path.String(), err)
+		}
+		contents, err := json.Marshal(doc)
+		if err != nil {
+			return "", err
+		}
+		hash, _, err := rest.CompareAndSet(t, path, &old, &contents)
+		if errors.Is(err, ErrConflict) || errors.Is(err, errNoCASHash) {
+			rest.log.Printf("patch %s: value changed, retrying (attempt %d)\n", path.String(), i+1)
+			continue
+		}
+		return hash, err
+	}
+	return "", fmt.Errorf("patch %s: value kept changing after %d attempts: %w", path.String(), maxPatchAttempts, ErrConflict)
+}
+
+// decodeJSON decodes b into v, keeping numbers as json.Number so they are written back unchanged
+func decodeJSON(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// parseJSONPointer splits a JSON pointer into its unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q: must start with /", pointer)
+	}
+	steps := strings.Split(pointer[1:], "/")
+	for i, s := range steps {
+		steps[i] = strings.Replace(strings.Replace(s, "~1", "/", -1), "~0", "~", -1)
+	}
+	return steps, nil
+}
+
+// setJSONPointer sets the element at steps in doc to v and returns the updated document
+func setJSONPointer(doc interface{}, steps []string, v interface{}) (interface{}, error) {
+	if len(steps) == 0 {
+		return v, nil
+	}
+	step := steps[0]
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[step]
+		if !ok && len(steps) > 1 {
+			return nil, fmt.Errorf("member %q does not exist", step)
+		}
+		n, err := setJSONPointer(child, steps[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		d[step] = n
+		return d, nil
+	case []interface{}:
+		if step == "-" && len(steps) == 1 {
+			return append(d, v), nil
+		}
+		i, err := strconv.Atoi(step)
+		if err != nil || i < 0 || i >= len(d) {
+			return nil, fmt.Errorf("invalid array index %q", step)
+		}
+		if d[i], err = setJSONPointer(d[i], steps[1:], v); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("can't set %q in a JSON value that is not an object or array", step)
+}
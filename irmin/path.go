@@ -18,8 +18,11 @@ package irmin
 
 import (
 	"bytes"
+	"fmt"
 	"net/url"
+	"sort"
 	"strings"
+	"unicode"
 )
 
 // Path is a path in an Irmin tree
@@ -31,14 +34,27 @@ func (path *Path) Delim() rune {
 }
 
 // ParseEncodedPath parses a path string separated by '/'. Each segment may be PCT encoded to escape '/' in the name. (see also url.QueryEscape)
+// An error is returned if a segment is empty, is not correctly encoded or contains control characters. An empty string or "/" is the root path.
 func ParseEncodedPath(p string) (Path, error) {
 	// TODO use delim() here
-	segs := strings.Split(strings.Trim(p, " /"), "/")
+	t := strings.Trim(p, " /")
+	if t == "" {
+		return Path{}, nil
+	}
+	segs := strings.Split(t, "/")
 	is := make([]Value, len(segs))
 	for i := range segs {
+		if segs[i] == "" {
+			return Path{}, fmt.Errorf("invalid path %q: empty segment %d", p, i)
+		}
 		s, err := url.QueryUnescape(segs[i])
 		if err != nil {
-			return Path{}, err
+			return Path{}, fmt.Errorf("invalid path %q: %s", p, err)
+		}
+		for _, r := range s {
+			if unicode.IsControl(r) {
+				return Path{}, fmt.Errorf("invalid path %q: segment %d contains control character %U", p, i, r)
+			}
 		}
 		is[i] = []byte(s)
 	}
@@ -46,10 +62,14 @@ func ParseEncodedPath(p string) (Path, error) {
 	return is, nil
 }
 
-// ParsePath parses a path string separated by '/'.
+// ParsePath parses a path string separated by '/'. The empty string and "/" are the root, an empty Path.
 func ParsePath(p string) Path {
 	// TODO use delim() here
-	segs := strings.Split(strings.Trim(p, " /"), "/")
+	p = strings.Trim(p, " /")
+	if p == "" {
+		return Path{}
+	}
+	segs := strings.Split(p, "/")
 	is := make([]Value, len(segs))
 	for i := range segs {
 		is[i] = []byte(segs[i])
@@ -89,3 +109,46 @@ func (path *Path) URL() *url.URL {
 	}
 
 }
+
+// HasPrefix returns true if the path starts with all steps in prefix. Every path has the empty path as prefix.
+func (path *Path) HasPrefix(prefix Path) bool {
+	if len(prefix) > len(*path) {
+		return false
+	}
+	for i := range prefix {
+		if !bytes.Equal((*path)[i], prefix[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// TrimPrefix returns the path relative to prefix and true, or the unchanged path and false if it does not start with prefix. Trimming a path from itself returns the empty path.
+func (path *Path) TrimPrefix(prefix Path) (Path, bool) {
+	if !path.HasPrefix(prefix) {
+		return *path, false
+	}
+	return append(Path{}, (*path)[len(prefix):]...), true
+}
+
+// Compare compares two paths step by step. Steps are compared as raw bytes in lexicographic order, and the first step that differs decides the order. If one path is a prefix of the other, the shorter path sorts first. Returns -1 if path sorts before other, 1 if it sorts after and 0 if they are equal.
+func (path *Path) Compare(other Path) int {
+	p := *path
+	for i := 0; i < len(p) && i < len(other); i++ {
+		if c := bytes.Compare(p[i], other[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(p) < len(other):
+		return -1
+	case len(p) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// SortPaths sorts paths in place in the order defined by Path.Compare
+func SortPaths(paths []Path) {
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Compare(paths[j]) < 0 })
+}
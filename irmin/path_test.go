@@ -0,0 +1,119 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseEncodedPathRejects(t *testing.T) {
+	for _, p := range []string{
+		"a//b",    // empty segment
+		"a/%zz/b", // bad escape
+		"a/%",     // truncated escape
+		"a/%01",   // control character
+		"a/b%7F",  // DEL is a control character too
+	} {
+		if path, err := ParseEncodedPath(p); err == nil {
+			t.Errorf("%q: got %q, expected an error", p, path.String())
+		}
+	}
+	for p, want := range map[string]string{
+		"":           "",
+		"/":          "",
+		"a/b":        "/a/b",
+		"/a%2Fb/c/":  "/a/b/c", // String does not escape the slash in the first step
+		"a+b/%C3%A9": "/a b/é",
+	} {
+		path, err := ParseEncodedPath(p)
+		if err != nil || path.String() != want {
+			t.Errorf("%q: got %q, %v, expected %q", p, path.String(), err, want)
+		}
+	}
+	if path, _ := ParseEncodedPath("a%2Fb/c"); len(path) != 2 || path[0].String() != "a/b" {
+		t.Errorf("got steps %q, expected the escaped slash to stay in the first step", path)
+	}
+}
+
+func TestPathCompare(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"a/b", "a/b", 0},
+		{"", "a", -1},    // the root sorts first
+		{"a", "a/b", -1}, // a prefix sorts before longer paths
+		{"a/b/c", "a/b", 1},
+		{"a/b", "a/c", -1}, // shared prefix, the first different step decides
+		{"a/z", "b", -1},   // length does not matter once a step differs
+		{"ab", "a/b", 1},   // steps are compared, not the joined string
+		{"B", "a", -1},     // raw bytes, so upper case sorts first
+		{"a/b", "a/ba", -1},
+	} {
+		a, b := ParsePath(tc.a), ParsePath(tc.b)
+		if got := a.Compare(b); got != tc.want {
+			t.Errorf("%q.Compare(%q) = %d, expected %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := b.Compare(a); got != -tc.want {
+			t.Errorf("%q.Compare(%q) = %d, expected %d", tc.b, tc.a, got, -tc.want)
+		}
+	}
+}
+
+func TestSortPaths(t *testing.T) {
+	paths := []Path{ParsePath("b"), ParsePath("a/b/c"), ParsePath("ab"), ParsePath(""), ParsePath("a/b"), ParsePath("a"), ParsePath("a/c")}
+	SortPaths(paths)
+	var got []string
+	for _, p := range paths {
+		got = append(got, p.String())
+	}
+	if want := []string{"", "/a", "/a/b", "/a/b/c", "/a/c", "/ab", "/b"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+}
+
+func TestPathTrimPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		path, prefix string
+		want         string
+		ok           bool
+	}{
+		{"a/b/c", "a", "/b/c", true},
+		{"a/b/c", "a/b", "/c", true},
+		{"a/b", "a/b", "", true},  // exact match
+		{"a/b", "", "/a/b", true}, // every path is below the root
+		{"a/b", "b", "/a/b", false},
+		{"ab/c", "a", "/ab/c", false}, // steps must match completely
+		{"a", "a/b", "/a", false},     // prefix longer than the path
+	} {
+		path := ParsePath(tc.path)
+		rel, ok := path.TrimPrefix(ParsePath(tc.prefix))
+		if rel.String() != tc.want || ok != tc.ok {
+			t.Errorf("%q.TrimPrefix(%q) = %q, %v, expected %q, %v", tc.path, tc.prefix, rel.String(), ok, tc.want, tc.ok)
+		}
+	}
+
+	// the result does not share steps with the original path
+	path := ParsePath("a/b/c")
+	rel, _ := path.TrimPrefix(ParsePath("a"))
+	rel[0] = NewValue("x")
+	if path.String() != "/a/b/c" {
+		t.Errorf("changing the result changed the path to %s", path.String())
+	}
+}
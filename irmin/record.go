@@ -0,0 +1,214 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Interaction is a recorded request and its response. A recording is a file with one Interaction per line encoded as JSON, in the order the requests completed, e.g.
+//
+//	{"method":"GET","url":"/read/a/b","status":200,"content_type":"application/json","response":"{\"result\":[\"x\"]}"}
+//
+// URL is the path and query of the request, so a recording can be replayed against any base URI. Bodies are stored as strings, so requests should not be compressed while recording.
+type Interaction struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	Request     string `json:"request,omitempty"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Response    string `json:"response"`
+}
+
+// recorder is a http.RoundTripper that writes each interaction to w
+type recorder struct {
+	rt http.RoundTripper
+	mu sync.Mutex // protects w
+	w  io.Writer
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	in := Interaction{Method: req.Method, URL: req.URL.RequestURI()}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		in.Request = string(body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	res, err := r.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	in.Status = res.StatusCode
+	in.ContentType = res.Header.Get("Content-Type")
+	res.Body = &recordedBody{rc: res.Body, in: in, r: r}
+	return res, nil
+}
+
+// write appends an interaction to the recording
+func (r *recorder) write(in Interaction) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.w.Write(append(b, '\n'))
+	return err
+}
+
+// recordedBody keeps a copy of a response body and records the interaction when it is closed, so streams are recorded as far as they were read
+type recordedBody struct {
+	rc   io.ReadCloser
+	buf  bytes.Buffer
+	in   Interaction
+	r    *recorder
+	once sync.Once
+}
+
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordedBody) Close() error {
+	err := b.rc.Close()
+	b.once.Do(func() {
+		b.in.Response = b.buf.String()
+		if werr := b.r.write(b.in); werr != nil && err == nil {
+			err = werr
+		}
+	})
+	return err
+}
+
+// StartRecording records every request and response to w in the format described in Interaction. The recording can be served with Replay, e.g. to run tests without an Irmin server. The current transport is wrapped, so call this after SetTransport.
+func (rest *Conn) StartRecording(w io.Writer) {
+	rt := http.DefaultTransport
+	if rest.httpClient != nil && rest.httpClient.Transport != nil {
+		rt = rest.httpClient.Transport
+	}
+	rest.SetTransport(&recorder{rt: rt, w: w})
+}
+
+// replayer is a http.RoundTripper that serves recorded interactions. Each interaction is served once, to the first request that matches it.
+type replayer struct {
+	mu   sync.Mutex // protects used
+	ins  []Interaction
+	keys []string // requestKey of each recorded request body
+	used []bool
+}
+
+// requestKey returns the part of a request body that must match the recording. The date and uid of the task differ on every run, so they are left out.
+func requestKey(body string) string {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		return body
+	}
+	if raw, ok := req["task"]; ok {
+		var t Task
+		if err := json.Unmarshal(raw, &t); err == nil {
+			t.Date, t.UID = "", ""
+			req["task"], _ = json.Marshal(&t)
+		}
+	}
+	b, err := json.Marshal(req) // map keys are sorted
+	if err != nil {
+		return body
+	}
+	return string(b)
+}
+
+func (r *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var key string
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		key = requestKey(string(body))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := 0
+	for ; i < len(r.ins); i++ {
+		in := &r.ins[i]
+		if !r.used[i] && in.Method == req.Method && in.URL == req.URL.RequestURI() && r.keys[i] == key {
+			break
+		}
+	}
+	if i == len(r.ins) {
+		return nil, fmt.Errorf("replay: no recorded response left for %s %s", req.Method, req.URL.RequestURI())
+	}
+	r.used[i] = true
+	in := r.ins[i]
+	res := &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+		StatusCode:    in.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewBufferString(in.Response)),
+		ContentLength: int64(len(in.Response)),
+		Request:       req,
+	}
+	if in.ContentType != "" {
+		res.Header.Set("Content-Type", in.ContentType)
+	}
+	return res, nil
+}
+
+// Replay serves all requests from a recording made with StartRecording instead of the server. A request is answered with the first unused recorded interaction with the same method, URL and body, so concurrent requests can be made in any order, while identical requests get their responses in the order they were recorded. The date and uid of tasks are ignored when comparing bodies. Requests without a matching interaction fail with an error.
+func (rest *Conn) Replay(r io.Reader) error {
+	var ins []Interaction
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxRawFrameSize)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var in Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &in); err != nil {
+			return fmt.Errorf("replay: invalid recording: %w", err)
+		}
+		ins = append(ins, in)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	rp := &replayer{ins: ins, keys: make([]string, len(ins)), used: make([]bool, len(ins))}
+	for i, in := range ins {
+		if in.Request != "" {
+			rp.keys[i] = requestKey(in.Request)
+		}
+	}
+	rest.SetTransport(rp)
+	return nil
+}
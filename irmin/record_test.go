@@ -0,0 +1,76 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReplayOutOfOrder(t *testing.T) {
+	c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(r.URL.Path, "/update/") {
+			fmt.Fprint(w, `{"result":"abcd"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"result":[%q]}`, strings.TrimPrefix(r.URL.Path, "/read/"))
+	})
+	var rec bytes.Buffer
+	c.StartRecording(&rec)
+	keys := []string{"a", "b", "c", "d"}
+	for _, k := range keys {
+		if _, err := c.Read(ParsePath(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Update(c.NewTask("update"), ParsePath("a"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := Create(&url.URL{Scheme: "http", Host: "replay.invalid"}, "test")
+	if err := r.Replay(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Update(r.NewTask("update"), ParsePath("a"), []byte("y")); err == nil {
+		t.Fatal("an update with a different value was replayed")
+	}
+	// a new task has a different date and uid
+	if hash, err := r.Update(r.NewTask("update"), ParsePath("a"), []byte("x")); err != nil || hash != "abcd" {
+		t.Fatalf("got %q, %v from replayed update", hash, err)
+	}
+	var wg sync.WaitGroup
+	for i := len(keys) - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(k string) {
+			defer wg.Done()
+			v, err := r.Read(ParsePath(k))
+			if err != nil || string(v) != k {
+				t.Errorf("read %s: got %q, %v", k, v, err)
+			}
+		}(keys[i])
+	}
+	wg.Wait()
+	if _, err := r.Read(ParsePath("a")); err == nil {
+		t.Fatal("a recorded interaction was replayed twice")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	snapshotFormat  = "irmin-go-snapshot"
+	snapshotVersion = 1
+)
+
+// snapshotHeader is the first object in a snapshot
+type snapshotHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Irmin   string `json:"irmin"` // version of the Irmin server the snapshot was taken from
+	Commit  string `json:"commit"`
+	Prefix  Path   `json:"prefix,omitempty"` // set for subtrees exported with ExportSubtree
+}
+
+// snapshotEntry is a key and its value in a snapshot. The path is relative to the prefix in the header.
+type snapshotEntry struct {
+	Path  Path   `json:"path"`
+	Value *Value `json:"value"`
+}
+
+// Snapshot writes all keys and values at the current head to w. The snapshot is a stream of JSON objects: a header with the format name, a format version, the Irmin version and the commit the snapshot was taken from, followed by one object per key.
+func (rest *Conn) Snapshot(w io.Writer) error {
+	return rest.export(Path{}, w)
+}
+
+// ExportSubtree writes the keys and values below path at the current head to w, in the format used by Snapshot. The header also contains path as the prefix, and the keys are stored relative to it, so the subtree can be imported at another location with ImportSubtree. The subtree is listed level by level with one List request per node, so exporting a small subtree of a large store is cheap. The keys are listed before their values are written.
+func (rest *Conn) ExportSubtree(path Path, w io.Writer) error {
+	return rest.export(path, w)
+}
+
+// export writes the keys below prefix to w
+func (rest *Conn) export(prefix Path, w io.Writer) error {
+	version, err := rest.Version()
+	if err != nil {
+		return err
+	}
+	head, err := rest.Head()
+	if err != nil {
+		return err
+	}
+	commit := hex.EncodeToString(head)
+	at := rest.AtCommit(commit) // read from a fixed commit to get a consistent snapshot
+
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(&snapshotHeader{snapshotFormat, snapshotVersion, version, commit, prefix}); err != nil {
+		return err
+	}
+
+	if len(prefix) == 0 { // the whole tree, which a single iter request lists
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel() // stop the stream if we return early
+		ch, err := at.IterResults(ctx)
+		if err != nil {
+			return err
+		}
+		for r := range ch {
+			if r.Err != nil {
+				return r.Err
+			}
+			if err = exportKey(at, enc, r.Path, r.Path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// list the subtree level by level, so the work does not depend on the size of the rest of the store
+	keys, err := at.listRecursive(prefix, -1)
+	if err != nil {
+		return err
+	}
+	for _, k := range append([]Path{prefix}, keys...) { // the prefix itself may have a value
+		rel, _ := k.TrimPrefix(prefix)
+		if err = exportKey(at, enc, k, rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportKey writes the value of key to enc as an entry for rel. Keys without a value, such as nodes that only have children, are skipped.
+func exportKey(at *Conn, enc *json.Encoder, key, rel Path) error {
+	v, found, err := at.TryRead(key)
+	if err != nil || !found {
+		return err
+	}
+	value := Value(v)
+	return enc.Encode(&snapshotEntry{rel, &value})
+}
+
+// Restore writes all keys in a snapshot created by Snapshot to the current tree. Each key is written with a separate commit. Snapshots with an unknown format or version are rejected. A subtree exported with ExportSubtree is restored at the path it was exported from.
+func (rest *Conn) Restore(r io.Reader) error {
+	return rest.restore(r, nil)
+}
+
+// ImportSubtree writes all keys in a subtree exported with ExportSubtree below to, which may differ from the path the subtree was exported from. If to is nil the keys are written below the original path. Each key is written with a separate commit.
+func (rest *Conn) ImportSubtree(r io.Reader, to Path) error {
+	return rest.restore(r, to)
+}
+
+// restore writes the keys in a snapshot below to, or below the prefix in the snapshot header if to is nil
+func (rest *Conn) restore(r io.Reader, to Path) error {
+	if err := rest.checkWritable(); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(r)
+	var h snapshotHeader
+	if err := dec.Decode(&h); err != nil {
+		return fmt.Errorf("invalid snapshot header: %s", err)
+	}
+	if h.Format != snapshotFormat {
+		return fmt.Errorf("unknown snapshot format %q", h.Format)
+	}
+	if h.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d (expected %d)", h.Version, snapshotVersion)
+	}
+	if to == nil {
+		to = h.Prefix
+	}
+
+	t := rest.NewTask(fmt.Sprintf("restore snapshot of %s", h.Commit))
+	for dec.More() {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+		var v []byte
+		if e.Value != nil {
+			v = *e.Value
+		}
+		path := append(append(Path{}, to...), e.Path...)
+		if _, err := rest.Update(t, path, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
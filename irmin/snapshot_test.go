@@ -0,0 +1,169 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testStore is an in-memory store that serves the version, head, list, mem, read and update, with keys stored by their String form
+type testStore struct {
+	mu       sync.Mutex
+	values   map[string]string
+	requests []string
+}
+
+func (s *testStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	steps := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(steps) > 2 && steps[0] == "tree" {
+		steps = steps[2:]
+	}
+	s.requests = append(s.requests, steps[0])
+	key := strings.Join(steps[1:], "/")
+	switch steps[0] {
+	case "head":
+		fmt.Fprint(w, `{"result":["abcd"]}`)
+	case "": // version and commands
+		fmt.Fprint(w, `{"result":[],"version":"test"}`)
+	case "read":
+		if v, ok := s.values["/"+key]; ok {
+			b, _ := json.Marshal(v)
+			fmt.Fprintf(w, `{"result":[%s]}`, b)
+			return
+		}
+		fmt.Fprint(w, `{"result":[]}`)
+	case "mem":
+		_, ok := s.values["/"+key]
+		fmt.Fprintf(w, `{"result":%v}`, ok)
+	case "list":
+		children := map[string]bool{}
+		prefix := "/" + key + "/"
+		if key == "" {
+			prefix = "/"
+		}
+		for k := range s.values {
+			if strings.HasPrefix(k, prefix) {
+				child := strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)[0]
+				children[prefix+child] = true
+			}
+		}
+		var paths []Path
+		for k := range children {
+			paths = append(paths, ParsePath(k))
+		}
+		b, _ := json.Marshal(map[string]interface{}{"result": paths})
+		w.Write(b)
+	case "update":
+		var req struct{ Params Value }
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &req)
+		s.values["/"+key] = string(req.Params)
+		fmt.Fprint(w, `{"result":"abcd"}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestExportSubtree(t *testing.T) {
+	store := &testStore{values: map[string]string{
+		"/a":       "a",
+		"/a/b":     "ab",
+		"/a/b/c":   "abc",
+		"/a/d":     "ad",
+		"/other/x": "x",
+	}}
+	c := testConn(t, store.ServeHTTP)
+
+	var buf bytes.Buffer
+	if err := c.ExportSubtree(ParsePath("a"), &buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range store.requests {
+		if r == "iter" {
+			t.Fatal("the whole store was iterated to export a subtree")
+		}
+	}
+	if err := c.ImportSubtree(&buf, ParsePath("copy")); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"/copy": "a", "/copy/b": "ab", "/copy/b/c": "abc", "/copy/d": "ad"} {
+		if got, ok := store.values[k]; !ok || got != want {
+			t.Errorf("%s: got %q, expected %q", k, got, want)
+		}
+	}
+	if _, ok := store.values["/copy/x"]; ok {
+		t.Error("a key outside the subtree was exported")
+	}
+}
+
+func TestCountSubtree(t *testing.T) {
+	store := &testStore{values: map[string]string{
+		"/a":       "a",
+		"/a/b/c":   "abc",
+		"/a/d":     "ad",
+		"/ab":      "ab",
+		"/other/x": "x",
+	}}
+	c := testConn(t, store.ServeHTTP)
+	n, err := c.Count(ParsePath("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d keys under /a, expected 3", n)
+	}
+	for _, r := range store.requests {
+		if r == "iter" {
+			t.Fatal("the whole store was iterated to count a subtree")
+		}
+	}
+}
+
+func TestReadSubtreeNested(t *testing.T) {
+	store := &testStore{values: map[string]string{
+		"/a/b":     "ab",
+		"/a/b/c":   "abc",
+		"/a/d":     "ad",
+		"/other/x": "x",
+	}}
+	c := testConn(t, store.ServeHTTP)
+	m, err := c.ReadSubtreeNested(ParsePath("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"b": map[string]interface{}{"": []byte("ab"), "c": []byte("abc")},
+		"d": []byte("ad"),
+	}
+	if fmt.Sprintf("%q", m) != fmt.Sprintf("%q", want) {
+		t.Errorf("got %q, expected %q", m, want)
+	}
+	for _, r := range store.requests {
+		if r == "iter" {
+			t.Fatal("the whole store was iterated to read a subtree")
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// StoreStats contains statistics about an Irmin store
+type StoreStats struct {
+	Keys       int   // number of keys at the head of the current tree
+	ValueBytes int64 // total size of the values at the head of the current tree
+	Branches   int   // number of tags (branches)
+	Commits    int   // number of commits, or -1 if unknown
+}
+
+// StoreStats returns statistics about the store. Irmin has no statistics command, so Keys and ValueBytes are computed client-side by reading every key at the current head. This is expensive for large stores. Irmin does not report the number of commits, so Commits is always -1.
+func (rest *Conn) StoreStats() (StoreStats, error) {
+	stats := StoreStats{Commits: -1}
+
+	tags, err := rest.Tags()
+	if err != nil {
+		return stats, err
+	}
+	stats.Branches = len(tags)
+
+	head, err := rest.Head()
+	if err != nil {
+		return stats, err
+	}
+	at := rest.AtCommit(hex.EncodeToString(head)) // keys and sizes from the same commit
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // stop the stream if we return early
+	ch, err := at.IterResults(ctx)
+	if err != nil {
+		return stats, err
+	}
+	for r := range ch {
+		if r.Err != nil {
+			return stats, r.Err
+		}
+		v, err := at.Read(r.Path)
+		if err != nil {
+			return stats, err
+		}
+		stats.Keys++
+		stats.ValueBytes += int64(len(v))
+	}
+	return stats, nil
+}
+
+// BranchStats returns the number of keys, the head commit and the date of the head commit of a branch. The keys are counted client-side at the head commit, which requires iterating over the whole branch. Returns ErrUnknownRef if the branch does not exist.
+func (rest *Conn) BranchStats(name string) (keyCount int, headHash string, lastModified time.Time, err error) {
+	head, err := rest.FromTree(name).Head()
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	headHash = hex.EncodeToString(head)
+
+	c, err := rest.GetCommit(headHash)
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	date, err := strconv.ParseInt(c.Task.Date, 10, 64)
+	if err != nil {
+		return 0, "", time.Time{}, fmt.Errorf("commit %s has an invalid date %q", headHash, c.Task.Date)
+	}
+	lastModified = time.Unix(date, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := rest.AtCommit(headHash).IterResults(ctx)
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	for r := range ch {
+		if r.Err != nil {
+			return 0, "", time.Time{}, r.Err
+		}
+		keyCount++
+	}
+	return keyCount, headHash, lastModified, nil
+}
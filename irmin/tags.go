@@ -0,0 +1,224 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type tagsReply stringArrayReply
+type headsReply stringArrayReply
+type updateHeadReply stringReply
+
+type compareAndSetHeadReply struct {
+	Result  json.RawMessage
+	Error   errorValue
+	Version Value
+}
+
+// TagInfo describes a tag (branch) in Irmin and the commit it points to
+type TagInfo struct {
+	Name string // name of the tag
+	Head string // hash of the head commit
+	Task Task   // task (commit message) of the head commit
+}
+
+// Tags returns the names of all tags (branches) in Irmin
+func (rest *Conn) Tags() ([]string, error) {
+	var data tagsReply
+	uri, err := rest.MakeCallURL("tags", Path{}, false)
+	if err != nil {
+		return []string{}, err
+	}
+	if err = rest.Call(uri, nil, &data); err != nil {
+		return []string{}, err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		return []string{}, err
+	}
+
+	r := make([]string, len(data.Result))
+	for i, v := range data.Result {
+		r[i] = v.String()
+	}
+	return r, nil
+}
+
+// Heads returns the hashes of all head commits in Irmin
+func (rest *Conn) Heads() ([]string, error) {
+	var data headsReply
+	uri, err := rest.MakeCallURL("heads", Path{}, false)
+	if err != nil {
+		return []string{}, err
+	}
+	if err = rest.Call(uri, nil, &data); err != nil {
+		return []string{}, err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		return []string{}, err
+	}
+
+	r := make([]string, len(data.Result))
+	for i, v := range data.Result {
+		r[i] = v.String()
+	}
+	return r, nil
+}
+
+// tagDetailsConcurrency is the number of heads TagDetails looks up at the same time
+const tagDetailsConcurrency = 8
+
+// TagDetails returns all tags with their head commit and its task. The heads are looked up concurrently, at most tagDetailsConcurrency at a time.
+func (rest *Conn) TagDetails() ([]TagInfo, error) {
+	tags, err := rest.Tags()
+	if err != nil {
+		return []TagInfo{}, err
+	}
+
+	r := make([]TagInfo, len(tags))
+	errs := make([]error, len(tags))
+	next := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < tagDetailsConcurrency && w < len(tags); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				name := tags[i]
+				r[i].Name = name
+				head, err := rest.FromTree(name).Head()
+				if err != nil {
+					errs[i] = fmt.Errorf("head of %s: %w", name, err)
+					continue
+				}
+				r[i].Head = hex.EncodeToString(head)
+				c, err := rest.GetCommit(r[i].Head)
+				if err != nil {
+					errs[i] = fmt.Errorf("commit %s: %w", r[i].Head, err)
+					continue
+				}
+				r[i].Task = c.Task
+			}
+		}()
+	}
+	for i := range tags {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return []TagInfo{}, err
+		}
+	}
+	return r, nil
+}
+
+// CreateBranch creates a tag (branch) pointing to the commit fromCommit. Unlike Clone the new branch does not have to start from the current tree. If the branch already exists ErrRefExists is returned, unless force is set, in which case the branch is moved to fromCommit.
+func (rest *Conn) CreateBranch(name, fromCommit string, force bool) error {
+	if err := rest.checkWritable(); err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("create branch: empty name")
+	}
+	if err := validateHash(fromCommit); err != nil {
+		return err
+	}
+	if !force {
+		_, err := rest.Resolve(name)
+		if err == nil {
+			return fmt.Errorf("create branch %s: %w", name, ErrRefExists)
+		}
+		if !errors.Is(err, ErrUnknownRef) {
+			return err
+		}
+	}
+	return rest.FromTree(name).updateHead(rest.NewTask(fmt.Sprintf("create branch %s at %s", name, fromCommit)), fromCommit)
+}
+
+// CreateBranchIfAbsent creates a tag (branch) pointing to fromCommit if it does not exist yet, and reports whether it was created. If the server has a compare-and-set-head command the branch is created atomically. Otherwise this falls back to CreateBranch, which checks whether the branch exists before creating it, so a branch created concurrently by another client can be overwritten.
+func (rest *Conn) CreateBranchIfAbsent(name, fromCommit string) (created bool, err error) {
+	if err := rest.checkWritable(); err != nil {
+		return false, err
+	}
+	if name == "" {
+		return false, fmt.Errorf("create branch: empty name")
+	}
+	if err := validateHash(fromCommit); err != nil {
+		return false, err
+	}
+	ok, err := rest.SupportsCommand("compare-and-set-head")
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		err = rest.CreateBranch(name, fromCommit, false)
+		if errors.Is(err, ErrRefExists) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	var data compareAndSetHeadReply
+	var body postRequest
+	body.Task = rest.NewTask(fmt.Sprintf("create branch %s at %s", name, fromCommit))
+	commit := NewValue(fromCommit)
+	post := [][]*Value{[]*Value{nil}, []*Value{&commit}} // only set the head if there is none
+	if body.Data, err = json.Marshal(&post); err != nil {
+		return false, err
+	}
+	uri, err := rest.FromTree(name).MakeCallURL("compare-and-set-head", Path{}, true)
+	if err != nil {
+		return false, err
+	}
+	if err = rest.Call(uri, &body, &data); err != nil {
+		return false, err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(data.Result, &created); err != nil {
+		return false, fmt.Errorf("compare-and-set-head %s: invalid result %s", name, data.Result)
+	}
+	return created, nil
+}
+
+// updateHead sets the head of the current tree to the given commit
+func (rest *Conn) updateHead(t Task, commit string) error {
+	var data updateHeadReply
+	var err error
+	var body postRequest
+	body.Task = t
+	v := NewValue(commit)
+	if body.Data, err = v.MarshalJSON(); err != nil {
+		return err
+	}
+	uri, err := rest.MakeCallURL("update-head", Path{}, true)
+	if err != nil {
+		return err
+	}
+	if err = rest.Call(uri, &body, &data); err != nil {
+		return err
+	}
+	return rest.replyError(data.Error)
+}
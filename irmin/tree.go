@@ -0,0 +1,149 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	pathpkg "path"
+)
+
+// ReadSubtreeNested reads all keys under path into nested maps, one level per path step, with the values as []byte. A key that has both a value and children is stored as a map with the value under the empty key "". All keys are read from the current head into memory, so this is only suitable for small subtrees.
+func (rest *Conn) ReadSubtreeNested(path Path) (map[string]interface{}, error) {
+	head, err := rest.Head()
+	if err != nil {
+		return nil, err
+	}
+	at := rest.AtCommit(hex.EncodeToString(head)) // read all keys from the same commit
+
+	// list the subtree level by level, so the work does not depend on the size of the rest of the store
+	keys, err := at.listRecursive(path, -1)
+	if err != nil {
+		return nil, err
+	}
+	root := map[string]interface{}{}
+	for _, k := range keys {
+		v, found, err := at.TryRead(k)
+		if err != nil {
+			return nil, err
+		}
+		if !found { // a node that only has children
+			continue
+		}
+		rel, _ := k.TrimPrefix(path)
+		insertNested(root, rel, v)
+	}
+	return root, nil
+}
+
+// insertNested stores value in m at the position given by the steps in path
+func insertNested(m map[string]interface{}, path Path, value []byte) {
+	for _, step := range path[:len(path)-1] {
+		k := step.String()
+		switch c := m[k].(type) {
+		case map[string]interface{}:
+			m = c
+		case []byte: // key has a value and children
+			n := map[string]interface{}{"": c}
+			m[k] = n
+			m = n
+		default:
+			n := map[string]interface{}{}
+			m[k] = n
+			m = n
+		}
+	}
+	last := path[len(path)-1]
+	k := last.String()
+	if c, ok := m[k].(map[string]interface{}); ok {
+		c[""] = value
+	} else {
+		m[k] = value
+	}
+}
+
+// ListFiltered returns the keys in a path whose last step matches filter. The filter is a shell pattern as used by path.Match, e.g. "*.json" or "user-[0-9]*". The filter is sent to Irmin as the "filter" query parameter so servers that support it can filter the list, and is always applied to the result as well, so servers that ignore it return the same keys.
+func (rest *Conn) ListFiltered(path Path, filter string) ([]Path, error) {
+	if _, err := pathpkg.Match(filter, ""); err != nil {
+		return []Path{}, fmt.Errorf("invalid filter %q: %s", filter, err)
+	}
+
+	var data listReply
+	uri, err := rest.MakeCallURLWithParams("list", path, true, url.Values{"filter": {filter}})
+	if err != nil {
+		return []Path{}, err
+	}
+	if err = rest.Call(uri, nil, &data); err != nil {
+		return []Path{}, err
+	}
+	if err = rest.replyError(data.Error); err != nil {
+		return []Path{}, err
+	}
+
+	r := []Path{}
+	for _, p := range data.Result {
+		if len(p) == 0 {
+			continue
+		}
+		if ok, _ := pathpkg.Match(filter, p[len(p)-1].String()); ok {
+			r = append(r, p)
+		}
+	}
+	if rest.sortResults {
+		SortPaths(r)
+	}
+	return r, nil
+}
+
+// ListRecursive returns the keys below path up to depth levels further down. A depth of 0 returns the immediate children like List, 1 also returns their children, and so on. A negative depth is an error; use Iter to list every key. Keys are listed level by level at the current head, with one List request per key above the deepest level, so the result is consistent even if the tree changes meanwhile.
+func (rest *Conn) ListRecursive(path Path, depth int) ([]Path, error) {
+	if depth < 0 {
+		return []Path{}, fmt.Errorf("invalid depth %d", depth)
+	}
+	head, err := rest.Head()
+	if err != nil {
+		return []Path{}, err
+	}
+	r, err := rest.AtCommit(hex.EncodeToString(head)).listRecursive(path, depth)
+	if err != nil {
+		return []Path{}, err
+	}
+	if rest.sortResults {
+		SortPaths(r)
+	}
+	return r, nil
+}
+
+// listRecursive lists the keys below path in the current tree like ListRecursive, but a negative depth lists all levels
+func (rest *Conn) listRecursive(path Path, depth int) ([]Path, error) {
+	r := []Path{}
+	level := []Path{path}
+	for d := 0; (depth < 0 || d <= depth) && len(level) > 0; d++ {
+		var next []Path
+		for _, p := range level {
+			children, err := rest.List(p)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, children...)
+		}
+		r = append(r, next...)
+		level = next
+	}
+	return r, nil
+}
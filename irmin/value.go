@@ -20,6 +20,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"unicode/utf8"
 )
 
@@ -31,6 +32,43 @@ func NewValue(s string) Value {
 	return []byte(s)
 }
 
+// ValueFromInt creates a new Value containing the decimal representation of an integer
+func ValueFromInt(i int64) Value {
+	return NewValue(strconv.FormatInt(i, 10))
+}
+
+// ValueFromBool creates a new Value containing "true" or "false"
+func ValueFromBool(b bool) Value {
+	return NewValue(strconv.FormatBool(b))
+}
+
+// MustValue creates a new Value from a string, []byte, bool or integer. It panics for other types and is intended for tests and constants.
+func MustValue(v interface{}) Value {
+	switch x := v.(type) {
+	case string:
+		return NewValue(x)
+	case []byte:
+		return Value(x)
+	case Value:
+		return x
+	case bool:
+		return ValueFromBool(x)
+	case int:
+		return ValueFromInt(int64(x))
+	case int32:
+		return ValueFromInt(int64(x))
+	case int64:
+		return ValueFromInt(x)
+	case uint:
+		return NewValue(strconv.FormatUint(uint64(x), 10))
+	case uint32:
+		return NewValue(strconv.FormatUint(uint64(x), 10))
+	case uint64:
+		return NewValue(strconv.FormatUint(x, 10))
+	}
+	panic(fmt.Sprintf("MustValue: unsupported type %T", v))
+}
+
 // String returns the string representation of a value
 func (i *Value) String() string {
 	return string(*i)
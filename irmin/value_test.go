@@ -0,0 +1,92 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValueRoundTrip(t *testing.T) {
+	store := &testStore{values: map[string]string{}}
+	c := testConn(t, store.ServeHTTP)
+	key := ParsePath("a")
+
+	for _, i := range []int64{0, 1, -1, 42, math.MaxInt64, math.MinInt64} {
+		if _, err := c.Update(c.NewTask("int"), key, ValueFromInt(i)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.ReadInt(key); err != nil || got != i {
+			t.Errorf("wrote %d, read %d, %v", i, got, err)
+		}
+	}
+	for _, b := range []bool{true, false} {
+		if _, err := c.Update(c.NewTask("bool"), key, ValueFromBool(b)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.ReadBool(key); err != nil || got != b {
+			t.Errorf("wrote %v, read %v, %v", b, got, err)
+		}
+	}
+
+	if _, err := c.Update(c.NewTask("string"), key, MustValue("not a number")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadInt(key); err == nil {
+		t.Error("ReadInt accepted a value that is not an integer")
+	}
+	if _, err := c.ReadBool(key); err == nil {
+		t.Error("ReadBool accepted a value that is not a bool")
+	}
+}
+
+func TestMustValue(t *testing.T) {
+	for _, tc := range []struct {
+		v    interface{}
+		want string
+	}{
+		{"s", "s"},
+		{[]byte("b"), "b"},
+		{NewValue("v"), "v"},
+		{true, "true"},
+		{false, "false"},
+		{int(-1), "-1"},
+		{int32(math.MinInt32), "-2147483648"},
+		{int64(math.MaxInt64), "9223372036854775807"},
+		{uint(1), "1"},
+		{uint32(math.MaxUint32), "4294967295"},
+		{uint64(math.MaxUint64), "18446744073709551615"},
+	} {
+		if got := MustValue(tc.v); string(got) != tc.want {
+			t.Errorf("MustValue(%#v) = %q, expected %q", tc.v, got, tc.want)
+		}
+	}
+	if got := MustValue(int64(7)); string(got) != string(ValueFromInt(7)) {
+		t.Errorf("MustValue and ValueFromInt differ: %q", got)
+	}
+
+	for _, v := range []interface{}{1.5, nil, []string{"a"}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("MustValue(%#v) did not panic", v)
+				}
+			}()
+			MustValue(v)
+		}()
+	}
+}
@@ -17,7 +17,7 @@
 package irmin
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
@@ -55,8 +55,8 @@ func (rest *Conn) CreateView(t Task, path Path) (*View, error) {
 	if err != nil {
 		return nil, err
 	}
-	if data.Error.String() != "" {
-		return nil, fmt.Errorf(data.Error.String())
+	if err = rest.replyError(data.Error); err != nil {
+		return nil, err
 	}
 	if data.Result.String() == "" {
 		return nil, fmt.Errorf("empty result")
@@ -97,8 +97,8 @@ func (view *View) Read(path Path) ([]byte, error) {
 	if err = view.srv.Call(uri, nil, &data); err != nil {
 		return []byte{}, err
 	}
-	if data.Error.String() != "" {
-		return []byte{}, fmt.Errorf(data.Error.String())
+	if err = view.srv.replyError(data.Error); err != nil {
+		return []byte{}, err
 	}
 	return data.Result, nil
 }
@@ -139,11 +139,11 @@ func (view *View) Update(t Task, path Path, contents []byte) (string, error) {
 	if err = view.srv.Call(uri, &body, &data); err != nil {
 		return data.Result.String(), err
 	}
-	if data.Error.String() != "" {
-		return "", fmt.Errorf(data.Error.String())
+	if err = view.srv.replyError(data.Error); err != nil {
+		return "", err
 	}
 	if data.Result.String() == "" {
-		return "", fmt.Errorf("update seemed to succeed, but didn't return a hash", path.String(), data.Result.String())
+		return "", fmt.Errorf("update %s seemed to succeed, but didn't return a hash", path.String())
 	}
 
 	view.node = data.Result.String() // Store new node position
@@ -151,8 +151,42 @@ func (view *View) Update(t Task, path Path, contents []byte) (string, error) {
 	return view.node, nil
 }
 
+// Remove a key from the view. The view moves to the node returned by Irmin, like Update.
+func (view *View) Remove(t Task, path Path) error {
+	var data viewUpdateReply
+	var err error
+
+	body := postRequest{Task: t}
+
+	cmd := fmt.Sprintf("view/%s/remove", url.QueryEscape(view.node))
+	uri, err := view.srv.MakeCallURL(cmd, path, false)
+	if err != nil {
+		return err
+	}
+	if err = view.srv.Call(uri, &body, &data); err != nil {
+		return err
+	}
+	if err = view.srv.replyError(data.Error); err != nil {
+		return err
+	}
+	if data.Result.String() != "" {
+		view.node = data.Result.String() // Store new node position
+	}
+
+	return nil
+}
+
 // MergePath will attempt to merge view into the specified branch and path. An empty tree value defaults to master.
 func (view *View) MergePath(t Task, tree string, path Path) error {
+	_, err := view.mergePath(t, tree, path)
+	return err
+}
+
+// mergePath merges the view like MergePath and returns the hash of the merge commit, or "" if the server did not report one
+func (view *View) mergePath(t Task, tree string, path Path) (string, error) {
+	if err := view.srv.checkWritable(); err != nil {
+		return "", err
+	}
 	var data viewMergeReply
 	var err error
 
@@ -161,7 +195,7 @@ func (view *View) MergePath(t Task, tree string, path Path) error {
 
 	body.Data, err = i.MarshalJSON()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	body.Task = t
@@ -169,25 +203,31 @@ func (view *View) MergePath(t Task, tree string, path Path) error {
 	cmd := fmt.Sprintf("tree/%s/view/%s/merge-path", url.QueryEscape(tree), url.QueryEscape(view.node))
 	uri, err := view.srv.MakeCallURL(cmd, path, false)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if err = view.srv.Call(uri, &body, &data); err != nil {
-		return err
+		return "", err
 	}
-	if data.Error.String() != "" {
-		return fmt.Errorf(data.Error.String())
+	if err = view.srv.replyError(data.Error); err != nil {
+		return "", err
 	}
 	// TODO Assumes succses if no error, should probably check result
 
-	return nil
+	if validateHash(data.Result.String()) != nil {
+		return "", nil
+	}
+	return data.Result.String(), nil
 }
 
 // UpdatePath writes the view into the specified tree and path. Overwrites existing values.
 func (view *View) UpdatePath(t Task, tree string, path Path) error {
+	if err := view.srv.checkWritable(); err != nil {
+		return err
+	}
 	var data viewUpdateReply
 	var err error
 
-	body := postRequest{t, nil}
+	body := postRequest{Task: t}
 
 	cmd := fmt.Sprintf("tree/%s/view/%s/update-path", url.QueryEscape(tree), url.QueryEscape(view.node))
 	uri, err := view.srv.MakeCallURL(cmd, path, false)
@@ -197,46 +237,27 @@ func (view *View) UpdatePath(t Task, tree string, path Path) error {
 	if err = view.srv.Call(uri, &body, &data); err != nil {
 		return err
 	}
-	if data.Error.String() != "" {
-		return fmt.Errorf(data.Error.String())
+	if err = view.srv.replyError(data.Error); err != nil {
+		return err
 	}
 	if data.Result.String() == "" {
-		return fmt.Errorf("update-path seemed to succeed, but didn't return a hash", path.String(), data.Result.String())
+		return fmt.Errorf("update-path %s seemed to succeed, but didn't return a hash", path.String())
 	}
 
 	return nil
 }
 
-// Iter iterates through all keys in a view. Returns results in a channel as they are received.
+// Iter iterates through all keys in a view. Returns results in a channel as they are received, in no particular order. The channel is closed early if a key can't be decoded.
 func (view *View) Iter() (<-chan *Path, error) {
-	var ch <-chan *streamReply
-	var err error
 	cmd := fmt.Sprintf("view/%s/iter", url.QueryEscape(view.node))
 	uri, err := view.srv.MakeCallURL(cmd, Path{}, false)
 	if err != nil {
 		return nil, err
 	}
-	if ch, err = view.srv.CallStream(uri, nil); err != nil || ch == nil {
-		return nil, err
-	}
-
-	out := make(chan *Path, 1)
-
-	go func() {
-		defer close(out)
-		for m := range ch {
-			p := new(Path)
-			if err := json.Unmarshal(m.Result, &p); err != nil {
-				panic(err) // TODO This should be returned to caller
-			}
-			out <- p
-		}
-	}()
-
-	return out, err
+	return view.srv.iterPaths(context.Background(), uri)
 }
 
 // NewTask creates a new task that can be be submitted with a command. This is used as the commit message by Irmin.
 func (view *View) NewTask(message string) Task {
-	return NewTask(view.srv.taskowner, message)
+	return view.srv.NewTask(message)
 }
@@ -0,0 +1,84 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WaitUntil waits until the value of a key satisfies predicate and returns that value. The predicate is called with nil if the key does not exist. If the server supports watches the key is watched, otherwise, or if the watch fails, it is read every poll interval, which must be positive. Returns the context error if ctx is cancelled first.
+func (rest *Conn) WaitUntil(ctx context.Context, path Path, predicate func([]byte) bool, poll time.Duration) ([]byte, error) {
+	if poll <= 0 {
+		return nil, fmt.Errorf("invalid poll interval %s", poll)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the watch
+
+	var changes <-chan *CommitValuePair
+	if ok, err := rest.SupportsCommand("watch"); err == nil && ok {
+		// start watching before the first read, so no change is missed
+		if changes, err = rest.watch(ctx, path); err != nil {
+			rest.log.Printf("watch %s failed, polling instead: %s\n", path.String(), err)
+		}
+	}
+
+	value, _, err := rest.TryRead(path)
+	if err != nil {
+		return nil, err
+	}
+	if predicate(value) {
+		return value, nil
+	}
+
+	for changes != nil {
+		select {
+		case c, ok := <-changes:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				rest.log.Printf("watch %s closed, polling instead\n", path.String())
+				changes = nil
+				break
+			}
+			if predicate(c.Value) {
+				return c.Value, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+		value, _, err := rest.TryRead(path)
+		if err != nil {
+			return nil, err
+		}
+		if predicate(value) {
+			return value, nil
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// WriteTo reads a key and writes the value to w. Returns the number of bytes written. A value sent as a JSON string, as Irmin does for UTF-8 values, is decoded from the reply as it is received and written to w in chunks, so it is never held in memory as a whole. Binary values sent as { "hex": ... }, and all values if a limit is set with SetMaxValueBytes or the read reply is decoded with SetReplyDecoder, are read first and then written at once. If the reply fails after part of the value has been written, the error is returned together with the number of bytes written.
+func (rest *Conn) WriteTo(path Path, w io.Writer) (int64, error) {
+	if _, ok := rest.decoders["read"]; ok || rest.maxValueBytes > 0 {
+		v, err := rest.Read(path)
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(v)
+		return int64(n), err
+	}
+
+	uri, err := rest.MakeCallURL("read", path, true)
+	if err != nil {
+		return 0, err
+	}
+	if err = rest.initialized(); err != nil {
+		return 0, err
+	}
+	rest.log.Printf("calling: %s\n", uri.String())
+	res, err := rest.do(uri, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 { // an error, which is decoded from the whole reply like Read does
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorReplyBytes))
+		if err != nil {
+			return 0, err
+		}
+		v, err := rest.decodeReadValue(uri, res, body, path)
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(v)
+		return int64(n), err
+	}
+
+	cw := &countingWriter{w: w}
+	err = rest.writeReadReply(res.Body, cw, path)
+	return cw.n, err
+}
+
+// maxErrorReplyBytes is the largest unsuccessful reply WriteTo reads
+const maxErrorReplyBytes = 1024 * 1024
+
+// writeReadReply decodes the reply to a read command from body and writes the value to w. The reply is decoded like decodeReadValue.
+func (rest *Conn) writeReadReply(body io.Reader, w io.Writer, path Path) error {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return fmt.Errorf("read %s: invalid reply", path.String())
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "result":
+			return writeReadResult(dec, body, w, path)
+		case "error":
+			var e errorValue
+			if err = dec.Decode(&e); err != nil {
+				return err
+			}
+			if err = rest.replyError(e); err != nil {
+				return err
+			}
+		default: // e.g. the version
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("invalid key %s: %w", path.String(), ErrNotFound)
+}
+
+// writeReadResult writes the value in the result list of a read reply, which dec has reached, to w. The rest of the reply is not read.
+func writeReadResult(dec *json.Decoder, body io.Reader, w io.Writer, path Path) error {
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('[') {
+		return fmt.Errorf("read %s: invalid result", path.String())
+	}
+	if !dec.More() {
+		return fmt.Errorf("invalid key %s: %w", path.String(), ErrNotFound)
+	}
+
+	// continue after the part of the body the decoder has already read
+	r := bufio.NewReader(io.MultiReader(dec.Buffered(), body))
+	c, err := skipSpace(r)
+	if err != nil {
+		return err
+	}
+	if c == '"' {
+		if err = copyJSONString(w, r); err != nil {
+			return err
+		}
+	} else { // not a string, e.g. { "hex": ... }
+		r.UnreadByte()
+		var v Value
+		vdec := json.NewDecoder(r)
+		if err = vdec.Decode(&v); err != nil {
+			return err
+		}
+		if _, err = w.Write(v); err != nil {
+			return err
+		}
+		r = bufio.NewReader(io.MultiReader(vdec.Buffered(), r))
+	}
+	if c, err = skipSpace(r); err != nil {
+		return err
+	}
+	if c != ']' {
+		return fmt.Errorf("read %s returned more than one result", path.String())
+	}
+	return nil
+}
+
+// skipSpace returns the first byte in r that is not JSON whitespace
+func skipSpace(r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			return c, nil
+		}
+	}
+}
+
+// noEOF maps io.EOF to io.ErrUnexpectedEOF, for a reply that ends before it is complete
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// copyJSONString decodes a JSON string from r, after its opening quote, and writes it to w. Escapes are decoded and invalid UTF-8 is replaced like json.Unmarshal does.
+func copyJSONString(w io.Writer, r *bufio.Reader) error {
+	bw := bufio.NewWriter(w)
+	err := decodeJSONString(bw, r)
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// decodeJSONString is copyJSONString with a buffered writer
+func decodeJSONString(w *bufio.Writer, r *bufio.Reader) error {
+	for {
+		c, _, err := r.ReadRune() // invalid UTF-8 is read as utf8.RuneError
+		if err != nil {
+			return noEOF(err)
+		}
+		switch {
+		case c == '"':
+			return nil
+		case c < ' ':
+			return fmt.Errorf("invalid character %q in string", c)
+		case c != '\\':
+			w.WriteRune(c)
+			continue
+		}
+		e, err := r.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		switch e {
+		case '"', '\\', '/':
+			w.WriteByte(e)
+		case 'b':
+			w.WriteByte('\b')
+		case 'f':
+			w.WriteByte('\f')
+		case 'n':
+			w.WriteByte('\n')
+		case 'r':
+			w.WriteByte('\r')
+		case 't':
+			w.WriteByte('\t')
+		case 'u':
+			var b [4]byte
+			if _, err = io.ReadFull(r, b[:]); err != nil {
+				return noEOF(err)
+			}
+			u, ok := parseHex4(b[:])
+			if !ok {
+				return fmt.Errorf("invalid escape \\u%s in string", b[:])
+			}
+			if utf16.IsSurrogate(u) { // characters outside the BMP are escaped as a pair of surrogates
+				next, err := r.Peek(6)
+				u2, ok := rune(0), false
+				if err == nil && next[0] == '\\' && next[1] == 'u' {
+					u2, ok = parseHex4(next[2:])
+				}
+				if pair := utf16.DecodeRune(u, u2); ok && pair != utf8.RuneError {
+					r.Discard(6)
+					u = pair
+				} else {
+					u = utf8.RuneError
+				}
+			}
+			w.WriteRune(u)
+		default:
+			return fmt.Errorf("invalid escape \\%c in string", e)
+		}
+	}
+}
+
+// parseHex4 parses the four hex digits of a \u escape
+func parseHex4(b []byte) (rune, bool) {
+	var u rune
+	for _, h := range b {
+		switch {
+		case '0' <= h && h <= '9':
+			u = u<<4 | rune(h-'0')
+		case 'a' <= h && h <= 'f':
+			u = u<<4 | rune(h-'a'+10)
+		case 'A' <= h && h <= 'F':
+			u = u<<4 | rune(h-'A'+10)
+		default:
+			return 0, false
+		}
+	}
+	return u, true
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,135 @@
+/*
+ Copyright (c) 2015 Magnus Skjegstad <magnus@skjegstad.com>
+
+ Permission to use, copy, modify, and distribute this software for any
+ purpose with or without fee is hereby granted, provided that the above
+ copyright notice and this permission notice appear in all copies.
+
+ THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package irmin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteToDecodes(t *testing.T) {
+	for _, value := range []string{
+		`"plain"`,
+		`""`,
+		`"esc \" \\ \/ \b \f \n \r \t"`,
+		`"é€ and 😀"`,
+		`"lone \ud83d surrogate \ude00 and \ud83dA"`,
+		"\"invalid \xff utf-8\"",
+		`{"hex":"00ff"}`,
+	} {
+		c := testConn(t, testStream(`{"version":"0.9","result":[`+value+`]}`))
+		var buf bytes.Buffer
+		n, err := c.WriteTo(ParsePath("a"), &buf)
+		if err != nil {
+			t.Errorf("%s: %s", value, err)
+			continue
+		}
+		var want Value
+		if err = json.Unmarshal([]byte(value), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) || n != int64(len(want)) {
+			t.Errorf("%s: wrote %q (%d bytes), expected %q", value, buf.Bytes(), n, want)
+		}
+	}
+}
+
+func TestWriteToErrors(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		reply  string
+		err    error
+	}{
+		{200, `{"result":[]}`, ErrNotFound},
+		{200, `{"version":"0.9"}`, ErrNotFound},
+		{404, `not found`, ErrNotFound},
+		{200, `{"error":{"message":"unknown tag master"}}`, ErrUnknownRef},
+		{500, `{"error":{"code":"conflict","message":"conflict"}}`, ErrConflict},
+		{200, `{"result":["a","b"]}`, nil},
+		{200, `{"result":["trunc`, io.ErrUnexpectedEOF},
+		{200, `{"result":["bad \q"]}`, nil},
+	} {
+		c := testConn(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			fmt.Fprint(w, tc.reply)
+		})
+		_, err := c.WriteTo(ParsePath("a"), ioutil.Discard)
+		if err == nil || (tc.err != nil && !errors.Is(err, tc.err)) {
+			t.Errorf("%d %s: got %v, expected %v", tc.status, tc.reply, err, tc.err)
+		}
+	}
+}
+
+// signalWriter closes got when the first bytes are written
+type signalWriter struct {
+	bytes.Buffer
+	got chan struct{}
+}
+
+func (w *signalWriter) Write(p []byte) (int, error) {
+	if w.Len() == 0 && len(p) > 0 {
+		close(w.got)
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestWriteToStreams(t *testing.T) {
+	chunk := strings.Repeat("x", 64*1024)
+	w := &signalWriter{got: make(chan struct{})}
+	c := testConn(t, func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, `{"result":["%s`, chunk)
+		rw.(http.Flusher).Flush()
+		select { // the rest of the value is only sent once the client has written the first part
+		case <-w.got:
+		case <-time.After(5 * time.Second):
+		}
+		fmt.Fprintf(rw, `%s"]}`, chunk)
+	})
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.WriteTo(ParsePath("a"), w)
+		done <- err
+	}()
+	select {
+	case <-w.got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was written before the whole reply was received")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != chunk+chunk {
+		t.Fatalf("wrote %d bytes, expected %d", w.Len(), 2*len(chunk))
+	}
+}
+
+func TestWriteToBuffered(t *testing.T) {
+	c := testConn(t, testStream(`{"result":["abcdef"]}`))
+	c.SetMaxValueBytes(3, true)
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(ParsePath("a"), &buf); err != nil || buf.String() != "abc" {
+		t.Fatalf("got %q, %v, expected the value limit to apply", buf.String(), err)
+	}
+}